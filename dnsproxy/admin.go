@@ -0,0 +1,171 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AdminConfig enables the http api managing the cache:
+//
+//	GET         /cache/stats                   LRU counters
+//	GET         /cache/keys                    cached keys and remaining ttl
+//	GET         /cache/entry?key= or ?name=&type=&do=  one cached answer
+//	POST|DELETE /cache/purge?name=[&suffix=1]  answers for a name, or a whole domain
+//	POST|DELETE /cache/flush                   every answer
+//
+// It has no authentication, listen_addr should only be reachable by
+// operators, it is "127.0.0.1:8053" when empty.
+type AdminConfig struct {
+	ListenAddr string `toml:"listen_addr"`
+}
+
+var defaultAdminAddr = "127.0.0.1:8053"
+
+type adminKey struct {
+	Key   string `json:"key"`
+	TTL   int64  `json:"ttl"`
+	Stale bool   `json:"stale,omitempty"`
+}
+
+type adminEntry struct {
+	adminKey
+	Msg *jsonMsg `json:"msg"`
+}
+
+type adminServer struct {
+	cache *Cache
+}
+
+// NewAdminServer returns the admin http server of cache.
+func NewAdminServer(cfg *AdminConfig, cache *Cache) *http.Server {
+	addr := cfg.ListenAddr
+	if addr == "" {
+		addr = defaultAdminAddr
+	}
+	return &http.Server{Addr: addr, Handler: newAdminHandler(cache)}
+}
+
+func newAdminHandler(cache *Cache) http.Handler {
+	a := &adminServer{cache: cache}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/stats", a.stats)
+	mux.HandleFunc("/cache/keys", a.keys)
+	mux.HandleFunc("/cache/entry", a.entry)
+	mux.HandleFunc("/cache/purge", a.purge)
+	mux.HandleFunc("/cache/flush", a.flush)
+	return mux
+}
+
+func (a *adminServer) stats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(a.cache.StatsJSON()))
+}
+
+func (a *adminServer) keys(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	now := time.Now()
+	items := a.cache.table.Items()
+	keys := make([]adminKey, 0, len(items))
+	for _, it := range items {
+		keys = append(keys, newAdminKey(it.Key, it.Value.(*cacheValue).exp.Sub(now)))
+	}
+	writeJSON(w, keys)
+}
+
+func (a *adminServer) entry(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+	key := q.Get("key")
+	if key == "" && q.Get("name") != "" {
+		buf, err := jsonQuery(q.Get("name"), q.Get("type"), q.Get("do"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := &dns.Msg{}
+		req.Unpack(buf)
+		key = cacheKey(req)
+	}
+
+	if key == "" {
+		http.Error(w, "missing key or name parameter", http.StatusBadRequest)
+		return
+	}
+
+	msg, ttl, ok := a.cache.Peek(key)
+	if !ok {
+		http.Error(w, "not cached: "+key, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, &adminEntry{adminKey: newAdminKey(key, ttl), Msg: newJSONMsg(msg)})
+}
+
+func (a *adminServer) purge(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	q := r.URL.Query()
+	name := q.Get("name")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+
+	suffix := q.Get("suffix") == "1" || q.Get("suffix") == "true"
+	n, err := a.cache.Purge(name, suffix)
+	if err != nil {
+		http.Error(w, "purge cache backend: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]int{"purged": n})
+}
+
+func (a *adminServer) flush(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if err := a.cache.Flush(); err != nil {
+		http.Error(w, "flush cache backend: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]bool{"flushed": true})
+}
+
+// newAdminKey rounds the remaining lifetime of key up to seconds, a
+// negative one is the time the entry has been stale.
+func newAdminKey(key string, remaining time.Duration) adminKey {
+	if remaining < 0 {
+		return adminKey{Key: key, TTL: int64(remaining / time.Second), Stale: true}
+	}
+	return adminKey{Key: key, TTL: int64((remaining + time.Second - 1) / time.Second)}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,98 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func adminDo(t *testing.T, method, url string, v interface{}) int {
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	c := NewCache(&CacheConfig{StaleTTL: 60})
+	defer c.Close()
+	srv := httptest.NewServer(newAdminHandler(c))
+	defer srv.Close()
+
+	for _, name := range []string{"example.com.", "www.example.com.", "a.b.example.com.", "example.org."} {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		c.Set(cacheKey(req), newTestMsg(name, name+" 300 IN A 1.1.1.1"))
+	}
+	age(c, "example.org./A/IN", 310*time.Second)
+
+	var keys []adminKey
+	if code := adminDo(t, "GET", srv.URL+"/cache/keys", &keys); code != http.StatusOK || len(keys) != 4 {
+		t.Fatalf("expect 4 keys, got %d %v", code, keys)
+	}
+	for _, k := range keys {
+		if k.Key == "example.org./A/IN" && (!k.Stale || k.TTL != -10) {
+			t.Errorf("expect example.org stale for 10s, got %+v", k)
+		} else if k.Key != "example.org./A/IN" && (k.Stale || k.TTL != 300) {
+			t.Errorf("expect %s ttl 300, got %+v", k.Key, k)
+		}
+	}
+
+	var entry adminEntry
+	if code := adminDo(t, "GET", srv.URL+"/cache/entry?name=www.example.com&type=A", &entry); code != http.StatusOK {
+		t.Fatalf("expect entry, got %d", code)
+	}
+	if entry.Key != "www.example.com./A/IN" || len(entry.Msg.Answer) != 1 || entry.Msg.Answer[0].Data != "1.1.1.1" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	if code := adminDo(t, "GET", srv.URL+"/cache/entry?key=missing", nil); code != http.StatusNotFound {
+		t.Errorf("expect 404 for missing key, got %d", code)
+	}
+	if code := adminDo(t, "GET", srv.URL+"/cache/purge?name=example.com", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("expect 405 for GET purge, got %d", code)
+	}
+
+	var purged map[string]int
+	adminDo(t, "POST", srv.URL+"/cache/purge?name=example.com", &purged)
+	if purged["purged"] != 1 {
+		t.Errorf("expect exact purge of 1, got %v", purged)
+	}
+	adminDo(t, "DELETE", srv.URL+"/cache/purge?name=example.com&suffix=1", &purged)
+	if purged["purged"] != 2 {
+		t.Errorf("expect suffix purge of 2, got %v", purged)
+	}
+
+	var stats map[string]interface{}
+	adminDo(t, "GET", srv.URL+"/cache/stats", &stats)
+	if stats["Length"] != float64(1) {
+		t.Errorf("expect 1 entry left, got %v", stats)
+	}
+
+	adminDo(t, "POST", srv.URL+"/cache/flush", nil)
+	if n := c.table.Size(); n != 0 {
+		t.Errorf("expect empty cache after flush, got %d", n)
+	}
+}
+
+func TestAdminDefaultAddr(t *testing.T) {
+	c := NewCache(&CacheConfig{})
+	defer c.Close()
+
+	if srv := NewAdminServer(&AdminConfig{}, c); srv.Addr != defaultAdminAddr {
+		t.Errorf("expect admin api on %s, got %q", defaultAdminAddr, srv.Addr)
+	}
+}
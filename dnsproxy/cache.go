@@ -1,44 +1,147 @@
 package dnsproxy
 
 import (
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
 )
 
 var (
 	defaultCap      = 10000
+	defaultCapBytes = 32 << 20
 	defaultTTL      = 60 * 5
+	defaultMaxTTL   = 60 * 60 * 24
+	defaultNegTTL   = 60 * 60
 	defaultInterval = 10
+
+	// staleAnswerTTL is the ttl of stale answers, RFC 8767 4
+	staleAnswerTTL uint32 = 30
+
+	// gcBatch is how many entries gc handles per lock of its queues
+	gcBatch = 1000
+	// minPrefetchWindow is the least time before expiry an entry is
+	// prefetched at
+	minPrefetchWindow = time.Second
+)
+
+const (
+	capUnitEntries = "entries"
+	capUnitBytes   = "bytes"
 )
 
+// CacheConfig controls the answer cache. An answer expires after the
+// smallest ttl of its records, clamped to [min_ttl, max_ttl]; ttl is used
+// for answers without any record. NXDOMAIN and NODATA answers expire after
+// the SOA minimum of their authority section (RFC 2308), at most
+// negative_ttl. Expired answers are kept stale_ttl seconds more, to be
+// served when every upstream fails (RFC 8767). Answers read in the second
+// half of their lifetime are refreshed once less than prefetch percent of
+// their ttl remains. With persist_path the cache is saved every
+// persist_interval seconds and on Close, and loaded again at start.
+// shards above 1 spreads the entries over that many LRU shards. cap counts
+// entries, or bytes of packed messages when cap_unit is "bytes". With a
+// [cache.redis] section answers are shared through a redis server, the
+// in-memory LRU staying in front of it.
 type CacheConfig struct {
-	Enable	bool `toml:enable`
-	Cap      int `toml:"cap"`
-	TTL      int `toml:"ttl"`
-	Interval int `toml:"interval"`
+	Enable      bool   `toml:"enable"`
+	Cap         int    `toml:"cap"`
+	CapUnit     string `toml:"cap_unit"`
+	TTL         int    `toml:"ttl"`
+	MinTTL      int    `toml:"min_ttl"`
+	MaxTTL      int    `toml:"max_ttl"`
+	NegativeTTL int    `toml:"negative_ttl"`
+	StaleTTL    int    `toml:"stale_ttl"`
+	Prefetch    int    `toml:"prefetch"`
+	Interval    int    `toml:"interval"`
+	Shards      int    `toml:"shards"`
+
+	PersistPath     string `toml:"persist_path"`
+	PersistInterval int    `toml:"persist_interval"`
+
+	Redis *RedisConfig `toml:"redis"`
 }
 
 type cacheValue struct {
-	val interface{}
-	exp time.Time
+	msg    *dns.Msg
+	stored time.Time
+	exp    time.Time
+	size   int
+}
+
+// cacheTable is where Cache keeps its entries, a LRUCache or a
+// ShardedLRUCache.
+type cacheTable interface {
+	Get(key string) (Value, bool)
+	Peek(key string) (Value, bool)
+	Set(key string, value Value)
+	Delete(key string) bool
+	DeleteIf(key string, fn func(Value) bool) bool
+	SetOnEvicted(fn func(key string, value Value))
+	Clear()
+	Accessed(key string) (time.Time, bool)
+	Items() []Item
+	Size() int64
+	KeyCapacity(key string) int64
+	StatsJSON() string
 }
 
 type Cache struct {
-	table    *LRUCache
+	table    cacheTable
 	done     chan struct{}
 	ttl      time.Duration
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	negTTL   time.Duration
+	staleTTL time.Duration
 	interval time.Duration
+	prefetch int
+	// sizeBytes makes entries weigh their packed length
+	sizeBytes bool
+
+	persistPath     string
+	persistInterval time.Duration
+
+	expiry     expiryQueue
+	prefetches expiryQueue
+	// prefetchWake tells prefetchLoop an earlier prefetch is scheduled
+	prefetchWake chan struct{}
+
+	backend CacheBackend
+	backoff backendBackoff
+
+	mu        sync.Mutex
+	refresher func(key string, req *dns.Msg)
 }
 
+// Size is 1, or the packed length of the message when the capacity is in
+// bytes.
 func (cv *cacheValue) Size() int {
+	if cv.size > 0 {
+		return cv.size
+	}
 	return 1
 }
 
 func NewCache(cfg *CacheConfig) *Cache {
+	sizeBytes := false
+	switch cfg.CapUnit {
+	case "", capUnitEntries:
+	case capUnitBytes:
+		sizeBytes = true
+	default:
+		logs.Warn("unknown cache.cap_unit %s, count entries", cfg.CapUnit)
+	}
+
 	cap := cfg.Cap
 	if cap <= 0 {
 		cap = defaultCap
+		if sizeBytes {
+			cap = defaultCapBytes
+		}
 	}
 
 	ttl := cfg.TTL
@@ -46,47 +149,428 @@ func NewCache(cfg *CacheConfig) *Cache {
 		ttl = defaultTTL
 	}
 
+	maxTTL := cfg.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultMaxTTL
+	}
+
+	minTTL := cfg.MinTTL
+	if minTTL < 0 {
+		minTTL = 0
+	}
+	if minTTL > maxTTL {
+		logs.Warn("cache.min_ttl %d is above cache.max_ttl %d, ignore it", minTTL, maxTTL)
+		minTTL = 0
+	}
+
+	negTTL := cfg.NegativeTTL
+	if negTTL <= 0 {
+		negTTL = defaultNegTTL
+	}
+
+	staleTTL := cfg.StaleTTL
+	if staleTTL < 0 {
+		staleTTL = 0
+	}
+
+	prefetch := cfg.Prefetch
+	if prefetch < 0 || prefetch > 100 {
+		prefetch = 0
+	}
+
 	intval := cfg.Interval
 	if intval <= 0 {
 		intval = defaultInterval
 	}
 
 	cache := &Cache{
-		ttl:      time.Second * time.Duration(ttl),
-		interval: time.Second * time.Duration(intval),
-		table:    NewLRUCache(int64(cap)),
-		done:     make(chan struct{}),
+		ttl:       time.Second * time.Duration(ttl),
+		minTTL:    time.Second * time.Duration(minTTL),
+		maxTTL:    time.Second * time.Duration(maxTTL),
+		negTTL:    time.Second * time.Duration(negTTL),
+		staleTTL:  time.Second * time.Duration(staleTTL),
+		interval:  time.Second * time.Duration(intval),
+		prefetch:  prefetch,
+		sizeBytes: sizeBytes,
+		table:     NewLRUCache(int64(cap)),
+		done:      make(chan struct{}),
+
+		prefetchWake: make(chan struct{}, 1),
+	}
+
+	if cfg.Redis != nil {
+		cache.backend = newRedisBackend(cfg.Redis)
+	}
+
+	if shards := maxShards(cfg.Shards, cap, sizeBytes); shards > 1 {
+		cache.table = NewShardedLRUCache(shards, int64(cap))
+	}
+	cache.table.SetOnEvicted(func(key string, value Value) {
+		cache.unschedule(key, value.(*cacheValue))
+	})
+
+	if cfg.PersistPath != "" {
+		cache.persistPath = cfg.PersistPath
+		cache.persistInterval = time.Second * time.Duration(cfg.PersistInterval)
+
+		n, err := cache.Load(cache.persistPath)
+		if err != nil && !os.IsNotExist(err) {
+			logs.Warn("load cache from %s fail: %v", cache.persistPath, err)
+		} else if err == nil {
+			logs.Info("load %d cache elements from %s", n, cache.persistPath)
+		}
+
+		if cache.persistInterval > 0 {
+			go cache.persist()
+		}
 	}
 
 	go cache.gc()
+	if cache.prefetch > 0 {
+		go cache.prefetchLoop()
+	}
 	return cache
 }
 
+// maxShards returns shards, lowered so that each shard holds at least one
+// entry, or one answer of the largest size when the capacity is in bytes.
+func maxShards(shards, cap int, sizeBytes bool) int {
+	min := 1
+	if sizeBytes {
+		min = dns.MaxMsgSize
+	}
+
+	if shards > 1 && cap/shards < min {
+		n := cap / min
+		if n < 1 {
+			n = 1
+		}
+		logs.Warn("cache.shards %d leaves less than %d of cache.cap %d per shard, use %d shards", shards, min, cap, n)
+		shards = n
+	}
+	return shards
+}
+
+// Close stops the cache, saving it first when persist_path is set.
 func (c *Cache) Close() {
 	close(c.done)
+	if c.persistPath != "" {
+		c.save()
+	}
+	if c.backend != nil {
+		c.backend.Close()
+	}
+}
+
+// SetRefresher sets the function prefetched entries are resolved again
+// with, it is expected to Set the new answer.
+func (c *Cache) SetRefresher(fn func(key string, req *dns.Msg)) {
+	c.mu.Lock()
+	c.refresher = fn
+	c.mu.Unlock()
+}
+
+// Get returns a copy of the cached answer for key, with the ttl of its
+// records decreased by the time spent in the cache.
+func (c *Cache) Get(key string) *dns.Msg {
+	now := time.Now()
+	cv := c.fetch(key, now)
+	if cv == nil {
+		return nil
+	}
+
+	if cv.exp.Before(now) {
+		if cv.exp.Add(c.staleTTL).Before(now) && c.table.DeleteIf(key, func(v Value) bool { return v == cv }) {
+			c.unschedule(key, cv)
+		}
+		return nil
+	}
+
+	return cv.answer(now)
+}
+
+// GetStale returns the answer for key even if it expired less than
+// stale_ttl ago, with the short ttl of stale answers.
+func (c *Cache) GetStale(key string) *dns.Msg {
+	now := time.Now()
+	cv := c.fetch(key, now)
+	if cv == nil {
+		return nil
+	}
+
+	if !cv.exp.Before(now) {
+		return cv.answer(now)
+	}
+
+	if cv.exp.Add(c.staleTTL).Before(now) {
+		return nil
+	}
+
+	return cv.staleAnswer(staleAnswerTTL)
 }
 
-func (c *Cache) Get(key string) interface{} {
-	val, ok := c.table.Get(key)
-	if ok {
-		cv := val.(*cacheValue)
-		if cv.exp.Before(time.Now()) {
-			c.table.Delete(key)
-			return nil
+// Peek returns the answer for key as Get would, without changing the LRU
+// order, and its remaining lifetime. A stale answer has its records' ttl
+// set to 0 and a negative lifetime.
+func (c *Cache) Peek(key string) (*dns.Msg, time.Duration, bool) {
+	val, ok := c.table.Peek(key)
+	if !ok {
+		return nil, 0, false
+	}
+
+	cv := val.(*cacheValue)
+	now := time.Now()
+	if cv.exp.Before(now) {
+		return cv.staleAnswer(0), cv.exp.Sub(now), true
+	}
+	return cv.answer(now), cv.exp.Sub(now), true
+}
+
+// Purge deletes the answers for name, and for the names under it when
+// suffix is set, from memory and from the backend. It returns how many
+// entries were deleted from memory. Other proxies sharing the backend
+// keep their in-memory copies until they expire.
+func (c *Cache) Purge(name string, suffix bool) (int, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	n := 0
+	for _, it := range c.table.Items() {
+		cv := it.Value.(*cacheValue)
+		if len(cv.msg.Question) == 0 {
+			continue
 		}
 
-		return cv.val
+		qname := strings.ToLower(cv.msg.Question[0].Name)
+		if qname == name || suffix && dns.IsSubDomain(name, qname) {
+			if c.table.DeleteIf(it.Key, func(v Value) bool { return v == cv }) {
+				c.unschedule(it.Key, cv)
+				n++
+			}
+		}
 	}
-	return nil
+
+	if c.backend == nil {
+		return n, nil
+	}
+
+	// keys start with the lowercased name and a slash, see cacheKey
+	patterns := []string{globEscape(name) + "/*"}
+	if suffix {
+		patterns = append(patterns, "*."+globEscape(name)+"/*")
+		if name == "." {
+			patterns = []string{"*"}
+		}
+	}
+	for _, pattern := range patterns {
+		if _, err := c.backend.DeleteMatch(pattern); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
 }
 
-func (c *Cache) Set(key string, val interface{}) {
+// Flush deletes every answer, from memory and from the backend. Their
+// schedules are dropped by the eviction hook, under the lock of the
+// table, an answer Set meanwhile keeps its own.
+func (c *Cache) Flush() error {
+	c.table.Clear()
+
+	if c.backend == nil {
+		return nil
+	}
+	_, err := c.backend.DeleteMatch("*")
+	return err
+}
+
+// StatsJSON returns the stats of the underlying LRU as a JSON object.
+func (c *Cache) StatsJSON() string {
+	return c.table.StatsJSON()
+}
+
+// Set caches a copy of msg under key until its ttl expires, answers with a
+// zero ttl are not cached. The OPT record is not kept, it is built again
+// for the client an answer is replayed to.
+func (c *Cache) Set(key string, msg *dns.Msg) {
+	ttl := c.msgTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+
+	msg = msg.Copy()
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	now := time.Now()
 	cv := &cacheValue{
-		val: val,
-		exp: time.Now().Add(c.ttl),
+		msg:    msg,
+		stored: now,
+		exp:    now.Add(ttl),
+	}
+	if c.sizeBytes {
+		cv.size = msg.Len()
+	}
+
+	if c.backend != nil {
+		c.store(key, cv)
+	}
+
+	c.add(key, cv)
+}
+
+// add puts cv in the table and schedules its expiry. An entry larger than
+// the capacity of its shard would evict every other entry and then
+// itself, it is not kept.
+func (c *Cache) add(key string, cv *cacheValue) bool {
+	if size := int64(cv.Size()); size > c.table.KeyCapacity(key) {
+		logs.Debug("cache %s not kept, %d larger than its shard capacity", key, size)
+		return false
 	}
 
 	c.table.Set(key, cv)
+	c.schedule(key, cv)
+	return true
+}
+
+// msgTTL returns how long msg may be cached.
+func (c *Cache) msgTTL(msg *dns.Msg) time.Duration {
+	if soa := negativeSOA(msg); soa != nil {
+		// RFC 2308 5, the smaller of the SOA ttl and its minimum field
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+
+		neg := time.Second * time.Duration(ttl)
+		if neg > c.negTTL {
+			neg = c.negTTL
+		}
+		return neg
+	}
+
+	ttl := c.ttl
+	if min, ok := minTTL(msg); ok {
+		ttl = time.Second * time.Duration(min)
+	}
+
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// staleAnswer copies the cached message with the ttl of every record set
+// to ttl.
+func (cv *cacheValue) staleAnswer(ttl uint32) *dns.Msg {
+	msg := cv.msg.Copy()
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	return msg
+}
+
+// answer copies the cached message with the ttl of every record decreased
+// by the elapsed time, and capped by the remaining lifetime of the entry.
+func (cv *cacheValue) answer(now time.Time) *dns.Msg {
+	msg := cv.msg.Copy()
+	elapsed := int64(now.Sub(cv.stored) / time.Second)
+	remaining := int64((cv.exp.Sub(now) + time.Second - 1) / time.Second)
+
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			// a ttl exhausted before the entry expires was raised by min_ttl
+			ttl := int64(hdr.Ttl) - elapsed
+			if ttl <= 0 || ttl > remaining {
+				ttl = remaining
+			}
+			hdr.Ttl = uint32(ttl)
+		}
+	}
+
+	return msg
+}
+
+// cacheable reports whether resp is a complete answer worth caching: a
+// successful one of any record type, or a negative one carrying the SOA
+// its lifetime is taken from.
+func cacheable(resp *dns.Msg) bool {
+	if resp.Truncated {
+		return false
+	}
+	if negativeSOA(resp) != nil {
+		return true
+	}
+	return resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0
+}
+
+// negativeSOA returns the SOA of the authority section of a NXDOMAIN or
+// NODATA (no error, empty answer) response, nil for other responses.
+func negativeSOA(msg *dns.Msg) *dns.SOA {
+	if msg.Rcode != dns.RcodeNameError && (msg.Rcode != dns.RcodeSuccess || len(msg.Answer) > 0) {
+		return nil
+	}
+
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// cacheKey identifies the answers to the question of req: its name, type,
+// class and whether DNSSEC records were requested, e.g.
+// "example.com./AAAA/IN" or "example.com./A/IN/do".
+func cacheKey(req *dns.Msg) string {
+	q := req.Question[0]
+	key := strings.ToLower(q.Name) + "/" + dns.Type(q.Qtype).String() + "/" + dns.Class(q.Qclass).String()
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		key += "/do"
+	}
+	return key
+}
+
+// cacheQuery rebuilds the query the answer msg cached under key was
+// resolved for.
+func cacheQuery(key string, msg *dns.Msg) *dns.Msg {
+	q := msg.Question[0]
+	req := &dns.Msg{}
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	if strings.HasSuffix(key, "/do") {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return req
+}
+
+// minTTL returns the smallest ttl of the records in msg.
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range rrs {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
 }
 
 func (c *Cache) gc() {
@@ -97,16 +581,183 @@ func (c *Cache) gc() {
 
 		case <-time.After(c.interval):
 			logs.Info("cache gcing")
-			deleted := 0
+			now := time.Now()
+			deleted := c.expire(now)
+			logs.Info("cache gc finished, delete %d elements, total size: %d", deleted, c.table.Size())
+		}
+	}
+}
 
-			items := c.table.Items()
-			for _, it := range items {
-				if it.Value.(*cacheValue).exp.Before(time.Now()) {
-					c.table.Delete(it.Key)
-					deleted += 1
+// prefetchLoop refreshes the entries as soon as their prefetch window
+// opens, it sleeps until the first one is due.
+func (c *Cache) prefetchLoop() {
+	for {
+		wait := c.interval
+		if at, ok := c.prefetches.next(); ok {
+			wait = time.Until(at)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+
+		case <-c.prefetchWake:
+			timer.Stop()
+
+		case <-timer.C:
+			if n := c.prefetchDue(time.Now()); n > 0 {
+				logs.Debug("cache prefetch %d elements", n)
+			}
+		}
+	}
+}
+
+// schedule queues the entry cv just cached under key for deletion once
+// it is past the stale window, and for prefetch.
+func (c *Cache) schedule(key string, cv *cacheValue) {
+	c.scheduleExpiry(key, cv)
+	c.schedulePrefetch(key, cv)
+}
+
+func (c *Cache) scheduleExpiry(key string, cv *cacheValue) {
+	c.expiry.push(cv.exp.Add(c.staleTTL), key, cv.exp)
+}
+
+func (c *Cache) schedulePrefetch(key string, cv *cacheValue) {
+	if c.prefetch > 0 && c.prefetches.push(cv.exp.Add(-c.prefetchWindow(cv)), key, cv.exp) {
+		select {
+		case c.prefetchWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unschedule drops the work queued for cv, deleted from under key.
+func (c *Cache) unschedule(key string, cv *cacheValue) {
+	c.expiry.remove(key, cv.exp)
+	c.prefetches.remove(key, cv.exp)
+}
+
+// lookup returns the value cached under the key of e, and whether it is
+// the one e was scheduled for. Two Sets racing on a key may leave the
+// schedule of the value they replaced, the current one is scheduled
+// again then.
+func (c *Cache) lookup(e expiryEntry) (*cacheValue, bool) {
+	val, ok := c.table.Peek(e.key)
+	if !ok {
+		return nil, false
+	}
+
+	cv := val.(*cacheValue)
+	return cv, cv.exp.Equal(e.exp)
+}
+
+// expire deletes the entries past their stale window, in batches of
+// gcBatch. An entry is only deleted if it is still the value scheduled,
+// a concurrent Set is not undone.
+func (c *Cache) expire(now time.Time) int {
+	deleted := 0
+	for {
+		due := c.expiry.popDue(now, gcBatch)
+		if len(due) == 0 {
+			return deleted
+		}
+
+		for _, e := range due {
+			cv, ok := c.lookup(e)
+			if cv == nil {
+				continue
+			}
+			if !ok {
+				c.scheduleExpiry(e.key, cv)
+				continue
+			}
+
+			if c.table.DeleteIf(e.key, func(v Value) bool { return v == cv }) {
+				c.prefetches.remove(e.key, cv.exp)
+				deleted++
+			}
+		}
+	}
+}
+
+// prefetchDue refreshes the entries whose prefetch window opened. Those
+// not read yet are looked at again a quarter of the window later, until
+// they expire.
+func (c *Cache) prefetchDue(now time.Time) int {
+	n := 0
+	for {
+		due := c.prefetches.popDue(now, gcBatch)
+		if len(due) == 0 {
+			return n
+		}
+
+		items := make([]Item, 0, len(due))
+		for _, e := range due {
+			cv, ok := c.lookup(e)
+			if cv == nil || !cv.exp.After(now) {
+				continue
+			}
+			if !ok {
+				c.schedulePrefetch(e.key, cv)
+				continue
+			}
+
+			accessed, _ := c.table.Accessed(e.key)
+			if !readLate(cv, accessed) {
+				if next := now.Add(c.prefetchWindow(cv) / 4); next.Before(cv.exp) {
+					c.prefetches.push(next, e.key, e.exp)
 				}
+				continue
 			}
-			logs.Info("cache gc finished, delete %d elements, total size: %d", deleted, c.table.Size())
+
+			items = append(items, Item{Key: e.key, Value: cv, Accessed: accessed})
+		}
+		n += c.prefetchItems(items, now)
+	}
+}
+
+// prefetchWindow returns how long before its expiry cv is prefetched, at
+// least minPrefetchWindow so that the refresh has time to complete.
+func (c *Cache) prefetchWindow(cv *cacheValue) time.Duration {
+	window := cv.exp.Sub(cv.stored) * time.Duration(c.prefetch) / 100
+	if window < minPrefetchWindow {
+		window = minPrefetchWindow
+	}
+	return window
+}
+
+// readLate reports whether cv was read in the second half of its lifetime.
+func readLate(cv *cacheValue, accessed time.Time) bool {
+	return accessed.After(cv.stored.Add(cv.exp.Sub(cv.stored) / 2))
+}
+
+// prefetchItems refreshes the items about to expire that were read in the
+// second half of their lifetime.
+func (c *Cache) prefetchItems(items []Item, now time.Time) int {
+	c.mu.Lock()
+	refresher := c.refresher
+	c.mu.Unlock()
+
+	if c.prefetch == 0 || refresher == nil {
+		return 0
+	}
+
+	n := 0
+	for _, it := range items {
+		cv := it.Value.(*cacheValue)
+		if !cv.exp.After(now) || len(cv.msg.Question) == 0 {
+			continue
 		}
+
+		if cv.exp.Sub(now) > c.prefetchWindow(cv) || !readLate(cv, it.Accessed) {
+			continue
+		}
+
+		refresher(it.Key, cacheQuery(it.Key, cv.msg))
+		n++
 	}
+	return n
 }
@@ -0,0 +1,189 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
+)
+
+var (
+	errShortValue = errors.New("short cache value")
+
+	// backendRetryMin and backendRetryMax bound the pause after a backend
+	// failure, it doubles with each failure in a row
+	backendRetryMin = time.Second
+	backendRetryMax = 30 * time.Second
+)
+
+// CacheBackend is a store of cached answers shared by several proxies,
+// the in-memory LRU of Cache stays in front of it. Get returns nil and no
+// error for a missing key. DeleteMatch deletes the keys matching a glob
+// pattern, where * and ? are wildcards and \ quotes the next character.
+type CacheBackend interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	DeleteMatch(pattern string) (int, error)
+	Close() error
+}
+
+// backendBackoff skips the backend for a while after it failed, so that
+// a slow or unreachable backend does not delay every cache miss.
+type backendBackoff struct {
+	mu    sync.Mutex
+	fails int
+	until time.Time
+}
+
+// skip reports whether the backend is still paused at now.
+func (b *backendBackoff) skip(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.until)
+}
+
+// fail pauses the backend, and returns the pause and whether the backend
+// was working until now.
+func (b *backendBackoff) fail(now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pause := backendRetryMax
+	if b.fails < 16 {
+		if d := backendRetryMin << uint(b.fails); d < pause {
+			pause = d
+		}
+	}
+	b.fails++
+	b.until = now.Add(pause)
+	return pause, b.fails == 1
+}
+
+// succeed resumes the backend, and reports whether it was failing.
+func (b *backendBackoff) succeed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := b.fails > 0
+	b.fails = 0
+	b.until = time.Time{}
+	return failed
+}
+
+// encodeCacheValue packs cv for a backend: the stored and expiry times in
+// unix nanoseconds, followed by the packed message.
+func encodeCacheValue(cv *cacheValue) ([]byte, error) {
+	msg, err := cv.msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 16+len(msg))
+	binary.BigEndian.PutUint64(buf, uint64(cv.stored.UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:], uint64(cv.exp.UnixNano()))
+	copy(buf[16:], msg)
+	return buf, nil
+}
+
+func decodeCacheValue(buf []byte) (*cacheValue, error) {
+	if len(buf) < 16 {
+		return nil, errShortValue
+	}
+
+	msg := &dns.Msg{}
+	if err := msg.Unpack(buf[16:]); err != nil {
+		return nil, err
+	}
+
+	return &cacheValue{
+		msg:    msg,
+		stored: time.Unix(0, int64(binary.BigEndian.Uint64(buf))),
+		exp:    time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:]))),
+	}, nil
+}
+
+// fetch returns the entry of key from the LRU, or from the backend when
+// the LRU has none or an expired one. A backend entry newer than the LRU
+// one is kept in the LRU. The backend is left alone for a while after it
+// failed.
+func (c *Cache) fetch(key string, now time.Time) *cacheValue {
+	var cv *cacheValue
+	if val, ok := c.table.Get(key); ok {
+		cv = val.(*cacheValue)
+		if !cv.exp.Before(now) || c.backend == nil {
+			return cv
+		}
+	}
+
+	if c.backend == nil || c.backoff.skip(now) {
+		return cv
+	}
+
+	buf, err := c.backend.Get(key)
+	if err != nil {
+		c.backendFailed("get "+key, err)
+		return cv
+	}
+	c.backendRecovered()
+	if buf == nil {
+		return cv
+	}
+
+	shared, err := decodeCacheValue(buf)
+	if err != nil {
+		logs.Warn("cache backend value of %s invalid: %v", key, err)
+		return cv
+	}
+
+	if cv != nil && !shared.exp.After(cv.exp) {
+		return cv
+	}
+
+	if c.sizeBytes {
+		shared.size = len(buf) - 16
+	}
+	c.add(key, shared)
+	return shared
+}
+
+// store writes cv to the backend, it is kept there until its stale window
+// ends.
+func (c *Cache) store(key string, cv *cacheValue) {
+	buf, err := encodeCacheValue(cv)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	if c.backoff.skip(now) {
+		return
+	}
+
+	ttl := cv.exp.Add(c.staleTTL).Sub(now)
+	if err := c.backend.Set(key, buf, ttl); err != nil {
+		c.backendFailed("set "+key, err)
+		return
+	}
+	c.backendRecovered()
+}
+
+// backendFailed pauses the backend after op failed, only the first
+// failure in a row is logged as a warning.
+func (c *Cache) backendFailed(op string, err error) {
+	pause, first := c.backoff.fail(time.Now())
+	if first {
+		logs.Warn("cache backend %s fail: %v, skip the backend for %v", op, err, pause)
+		return
+	}
+	logs.Debug("cache backend %s fail: %v, skip the backend for %v", op, err, pause)
+}
+
+func (c *Cache) backendRecovered() {
+	if c.backoff.succeed() {
+		logs.Info("cache backend is back")
+	}
+}
@@ -0,0 +1,117 @@
+package dnsproxy
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryEntry schedules work on the entry of key that expires at exp. The
+// entry may have been replaced meanwhile, exp tells whether the cached
+// value is still the one scheduled.
+type expiryEntry struct {
+	at    time.Time
+	key   string
+	exp   time.Time
+	index int
+}
+
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*expiryEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// expiryQueue orders cache entries by the time they are due, so that gc
+// only visits the entries it has work for. A key is queued once, its
+// entry is moved when the key is scheduled again and removed with the
+// cached value, the queue is no larger than the cache.
+type expiryQueue struct {
+	mu   sync.Mutex
+	h    expiryHeap
+	keys map[string]*expiryEntry
+}
+
+// push queues key at at, in place of its previous schedule, and reports
+// whether it is now the first due.
+func (q *expiryQueue) push(at time.Time, key string, exp time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.keys == nil {
+		q.keys = make(map[string]*expiryEntry)
+	}
+
+	if e, ok := q.keys[key]; ok {
+		e.at, e.exp = at, exp
+		heap.Fix(&q.h, e.index)
+	} else {
+		e = &expiryEntry{at: at, key: key, exp: exp}
+		heap.Push(&q.h, e)
+		q.keys[key] = e
+	}
+	return q.h[0].key == key
+}
+
+// remove drops the schedule of key if it is still the one of the value
+// expiring at exp.
+func (q *expiryQueue) remove(key string, exp time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e, ok := q.keys[key]; ok && e.exp.Equal(exp) {
+		heap.Remove(&q.h, e.index)
+		delete(q.keys, key)
+	}
+}
+
+// next returns when the first entry is due.
+func (q *expiryQueue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.h) == 0 {
+		return time.Time{}, false
+	}
+	return q.h[0].at, true
+}
+
+// popDue removes and returns at most max entries due at now, the lock is
+// not held for long on large backlogs.
+func (q *expiryQueue) popDue(now time.Time, max int) []expiryEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []expiryEntry
+	for len(due) < max && len(q.h) > 0 && !q.h[0].at.After(now) {
+		e := heap.Pop(&q.h).(*expiryEntry)
+		delete(q.keys, e.key)
+		due = append(due, *e)
+	}
+	return due
+}
+
+func (q *expiryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.h)
+}
@@ -0,0 +1,118 @@
+package dnsproxy
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
+)
+
+// persistEntry is the on-disk form of a cached answer.
+type persistEntry struct {
+	Key    string
+	Msg    []byte
+	Stored time.Time
+	Exp    time.Time
+}
+
+// Save writes the cached answers to path. The snapshot is written to a
+// temporary file first, so a crash never leaves a partial one behind.
+func (c *Cache) Save(path string) (int, error) {
+	items := c.table.Items()
+	entries := make([]persistEntry, 0, len(items))
+	for _, it := range items {
+		cv := it.Value.(*cacheValue)
+		buf, err := cv.msg.Copy().Pack()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, persistEntry{Key: it.Key, Msg: buf, Stored: cv.stored, Exp: cv.exp})
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := gob.NewEncoder(f).Encode(entries); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// Load adds the answers saved in path that are still fresh, or stale
+// within stale_ttl, to the cache.
+func (c *Cache) Load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var entries []persistEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	n := 0
+	// saved from most to least recently used, the last set is the newest
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Exp.Add(c.staleTTL).Before(now) {
+			continue
+		}
+
+		msg := &dns.Msg{}
+		if err := msg.Unpack(e.Msg); err != nil {
+			continue
+		}
+
+		cv := &cacheValue{msg: msg, stored: e.Stored, exp: e.Exp}
+		if c.sizeBytes {
+			cv.size = len(e.Msg)
+		}
+		if c.add(e.Key, cv) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// persist saves the cache every persist_interval.
+func (c *Cache) persist() {
+	for {
+		select {
+		case <-c.done:
+			return
+
+		case <-time.After(c.persistInterval):
+			c.save()
+		}
+	}
+}
+
+func (c *Cache) save() {
+	n, err := c.Save(c.persistPath)
+	if err != nil {
+		logs.Warn("save cache to %s fail: %v", c.persistPath, err)
+		return
+	}
+	logs.Info("save %d cache elements to %s", n, c.persistPath)
+}
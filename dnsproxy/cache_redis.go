@@ -0,0 +1,330 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	defaultRedisPrefix   = "dnsproxy:"
+	defaultRedisTimeout  = 1
+	defaultRedisPoolSize = 8
+	// redisScanCount is the number of keys a SCAN is asked to visit
+	redisScanCount = 1000
+
+	errRedisReply = errors.New("invalid redis reply")
+)
+
+// RedisConfig points the cache to a redis server shared with other
+// proxies, keys are prefixed with prefix.
+type RedisConfig struct {
+	Addr     string `toml:"addr"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+	Prefix   string `toml:"prefix"`
+	Timeout  int    `toml:"timeout"`
+	PoolSize int    `toml:"pool_size"`
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisBackend is a CacheBackend speaking the redis protocol (RESP) over
+// a pool of connections.
+type redisBackend struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+	poolSize int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newRedisBackend(cfg *RedisConfig) *redisBackend {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+
+	poolSize := cfg.PoolSize
+	if poolSize <= 0 {
+		poolSize = defaultRedisPoolSize
+	}
+
+	return &redisBackend{
+		addr:     cfg.Addr,
+		password: cfg.Password,
+		db:       cfg.DB,
+		prefix:   prefix,
+		timeout:  time.Duration(timeout) * time.Second,
+		poolSize: poolSize,
+	}
+}
+
+func (b *redisBackend) Get(key string) ([]byte, error) {
+	reply, err := b.do("GET", b.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	buf, ok := reply.([]byte)
+	if !ok {
+		return nil, errRedisReply
+	}
+	return buf, nil
+}
+
+func (b *redisBackend) Set(key string, value []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		return nil
+	}
+	_, err := b.do("SET", b.prefix+key, value, "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (b *redisBackend) Delete(key string) error {
+	_, err := b.do("DEL", b.prefix+key)
+	return err
+}
+
+// DeleteMatch scans the keys under the prefix matching pattern and
+// deletes them, one batch of keys per SCAN reply.
+func (b *redisBackend) DeleteMatch(pattern string) (int, error) {
+	match := globEscape(b.prefix) + pattern
+	cursor := "0"
+	n := 0
+	for {
+		reply, err := b.do("SCAN", cursor, "MATCH", match, "COUNT", strconv.Itoa(redisScanCount))
+		if err != nil {
+			return n, err
+		}
+
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return n, errRedisReply
+		}
+		next, ok := items[0].([]byte)
+		keys, ok2 := items[1].([]interface{})
+		if !ok || !ok2 {
+			return n, errRedisReply
+		}
+
+		if len(keys) > 0 {
+			reply, err := b.do(append([]interface{}{"DEL"}, keys...)...)
+			if err != nil {
+				return n, err
+			}
+			if deleted, ok := reply.(int64); ok {
+				n += int(deleted)
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+func (b *redisBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range b.idle {
+		c.conn.Close()
+	}
+	b.idle = nil
+	return nil
+}
+
+// do sends a command and returns its reply: nil, int64, string for status
+// replies, []byte for bulk strings or []interface{} for arrays. The
+// connection is given back to the pool unless it failed.
+func (b *redisBackend) do(args ...interface{}) (interface{}, error) {
+	c, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(b.timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		return nil, err
+	}
+
+	b.put(c)
+	return reply, err
+}
+
+func (b *redisBackend) get() (*redisConn, error) {
+	b.mu.Lock()
+	if n := len(b.idle); n > 0 {
+		c := b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		b.mu.Unlock()
+		return c, nil
+	}
+	b.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", b.addr, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if b.password != "" {
+		if _, err := c.do(b.timeout, "AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if b.db != 0 {
+		if _, err := c.do(b.timeout, "SELECT", strconv.Itoa(b.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (b *redisBackend) put(c *redisConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.idle) >= b.poolSize {
+		c.conn.Close()
+		return
+	}
+	b.idle = append(b.idle, c)
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var buf []byte
+		switch v := arg.(type) {
+		case string:
+			buf = []byte(v)
+		case []byte:
+			buf = v
+		default:
+			buf = []byte(fmt.Sprint(v))
+		}
+		fmt.Fprintf(c.w, "$%d\r\n", len(buf))
+		c.w.Write(buf)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.r)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errRedisReply
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, errRedisReply
+}
+
+// readRedisLine reads a line without its trailing \r\n.
+func readRedisLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errRedisReply
+	}
+	return line[:len(line)-2], nil
+}
+
+// globEscape quotes the characters of s special to redis glob patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,340 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeRedis is an in-process server for the few commands the redis
+// backend sends.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu   sync.Mutex
+	data map[string][]byte
+	exp  map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{ln: ln, password: password, data: map[string][]byte{}, exp: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+
+		items, _ := reply.([]interface{})
+		var args []string
+		for _, it := range items {
+			b, _ := it.([]byte)
+			args = append(args, string(b))
+		}
+		if len(args) == 0 {
+			fmt.Fprint(conn, "-ERR empty command\r\n")
+			continue
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		switch cmd {
+		case "AUTH":
+			if len(args) != 2 || args[1] != f.password {
+				fmt.Fprint(conn, "-ERR invalid password\r\n")
+				continue
+			}
+			authed = true
+			fmt.Fprint(conn, "+OK\r\n")
+
+		case "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+
+		case "GET":
+			f.mu.Lock()
+			v, ok := f.data[args[1]]
+			if exp, has := f.exp[args[1]]; has && exp.Before(time.Now()) {
+				ok = false
+			}
+			f.mu.Unlock()
+
+			if !ok {
+				fmt.Fprint(conn, "$-1\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+
+		case "SET":
+			f.mu.Lock()
+			f.data[args[1]] = []byte(args[2])
+			delete(f.exp, args[1])
+			if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+				ms, _ := strconv.Atoi(args[4])
+				f.exp[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			f.mu.Unlock()
+			fmt.Fprint(conn, "+OK\r\n")
+
+		case "DEL":
+			n := 0
+			f.mu.Lock()
+			for _, key := range args[1:] {
+				if _, ok := f.data[key]; ok {
+					n++
+				}
+				delete(f.data, key)
+			}
+			f.mu.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", n)
+
+		case "SCAN":
+			// every key in one reply, MATCH is the only option honored
+			pattern := "*"
+			if len(args) >= 4 && strings.ToUpper(args[2]) == "MATCH" {
+				pattern = args[3]
+			}
+
+			var keys []string
+			f.mu.Lock()
+			for key := range f.data {
+				if globMatch(pattern, key) {
+					keys = append(keys, key)
+				}
+			}
+			f.mu.Unlock()
+
+			fmt.Fprintf(conn, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+			for _, key := range keys {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(key), key)
+			}
+
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// globMatch matches s against a redis glob pattern made of *, ? and
+// quoted characters.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func (f *fakeRedis) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.data[key]
+	return ok
+}
+
+func TestRedisBackend(t *testing.T) {
+	f := startFakeRedis(t, "secret")
+	defer f.ln.Close()
+
+	cfg := &RedisConfig{Addr: f.ln.Addr().String(), Password: "secret", DB: 1}
+	b := newRedisBackend(cfg)
+	defer b.Close()
+
+	if v, err := b.Get("missing"); v != nil || err != nil {
+		t.Errorf("expect missing key, got %q %v", v, err)
+	}
+
+	value := []byte("a\r\nbinary\x00value")
+	if err := b.Set("key", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !f.has(defaultRedisPrefix + "key") {
+		t.Errorf("expect key stored with prefix %s", defaultRedisPrefix)
+	}
+
+	if v, err := b.Get("key"); err != nil || string(v) != string(value) {
+		t.Errorf("expect %q, got %q %v", value, v, err)
+	}
+
+	if err := b.Delete("key"); err != nil || f.has(defaultRedisPrefix+"key") {
+		t.Errorf("expect key deleted, got %v", err)
+	}
+
+	cfg.Password = "wrong"
+	if _, err := newRedisBackend(cfg).Get("key"); err == nil {
+		t.Error("expect auth failure")
+	}
+}
+
+func TestCacheSharedBackend(t *testing.T) {
+	f := startFakeRedis(t, "")
+	defer f.ln.Close()
+
+	cfg := &CacheConfig{Redis: &RedisConfig{Addr: f.ln.Addr().String()}}
+	c1 := NewCache(cfg)
+	defer c1.Close()
+	c2 := NewCache(cfg)
+	defer c2.Close()
+
+	c1.Set("a.tech", newTestMsg("a.tech.", "a.tech. 300 IN A 1.1.1.1"))
+
+	msg := c2.Get("a.tech")
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("expect answer shared by c1, got %v", msg)
+	}
+	if _, ok := c2.table.Peek("a.tech"); !ok {
+		t.Error("expect shared answer kept in memory")
+	}
+
+	// c2 expired its copy, c1 stored a newer answer meanwhile
+	age(c2, "a.tech", 400*time.Second)
+	c1.Set("a.tech", newTestMsg("a.tech.", "a.tech. 300 IN A 2.2.2.2"))
+	if msg := c2.Get("a.tech"); msg == nil || msg.Answer[0].String() != "a.tech.\t300\tIN\tA\t2.2.2.2" {
+		t.Errorf("expect newer answer from backend, got %v", msg)
+	}
+
+}
+
+func TestCacheBackendPurge(t *testing.T) {
+	f := startFakeRedis(t, "")
+	defer f.ln.Close()
+
+	cfg := &CacheConfig{Redis: &RedisConfig{Addr: f.ln.Addr().String()}}
+	c1 := NewCache(cfg)
+	defer c1.Close()
+	c2 := NewCache(cfg)
+	defer c2.Close()
+
+	keys := map[string]string{}
+	for _, name := range []string{"a.tech.", "www.a.tech.", "b.tech.", "xa.tech."} {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		keys[name] = cacheKey(req)
+		c1.Set(keys[name], newTestMsg(name, name+" 300 IN A 1.1.1.1"))
+	}
+
+	// c2 never read the answers, they are purged from the backend anyway
+	if n, err := c2.Purge("a.tech", false); n != 0 || err != nil {
+		t.Errorf("expect nothing purged from memory, got %d %v", n, err)
+	}
+	if msg := c2.Get(keys["a.tech."]); msg != nil {
+		t.Errorf("expect purged answer missed, got %v", msg)
+	}
+	if msg := c2.Get(keys["www.a.tech."]); msg == nil {
+		t.Error("expect answer under a.tech kept by an exact purge")
+	}
+
+	if n, err := c2.Purge("a.tech", true); n != 1 || err != nil {
+		t.Errorf("expect www.a.tech purged from memory, got %d %v", n, err)
+	}
+	for name, expect := range map[string]bool{"www.a.tech.": false, "b.tech.": true, "xa.tech.": true} {
+		if ok := f.has(defaultRedisPrefix + keys[name]); ok != expect {
+			t.Errorf("%s: expect in backend %v", name, expect)
+		}
+	}
+
+	if err := c2.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if msg := c2.Get(keys["b.tech."]); msg != nil {
+		t.Errorf("expect flushed answer missed, got %v", msg)
+	}
+	if f.has(defaultRedisPrefix + keys["xa.tech."]) {
+		t.Error("expect backend flushed")
+	}
+}
+
+func TestCacheBackendBackoff(t *testing.T) {
+	// a server closing every connection, each dial is counted
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var mu sync.Mutex
+	dials := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			dials++
+			mu.Unlock()
+			conn.Close()
+		}
+	}()
+
+	c := NewCache(&CacheConfig{Redis: &RedisConfig{Addr: ln.Addr().String()}})
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		if msg := c.Get("a.tech./A/IN"); msg != nil {
+			t.Fatalf("expect miss, got %v", msg)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if dials != 1 {
+		t.Errorf("expect the failing backend tried once, got %d", dials)
+	}
+}
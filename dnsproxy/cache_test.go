@@ -0,0 +1,524 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestMsg(name string, rrs ...string) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetQuestion(name, dns.TypeA)
+	msg.Response = true
+	for _, s := range rrs {
+		rr, _ := dns.NewRR(s)
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return msg
+}
+
+// age moves the cached entry of key d into the past. The entry is replaced
+// rather than modified, it may be read by the workers of a running proxy.
+func age(c *Cache, key string, d time.Duration) {
+	val, _ := c.table.Peek(key)
+	cv := *val.(*cacheValue)
+	cv.stored = cv.stored.Add(-d)
+	cv.exp = cv.exp.Add(-d)
+	c.table.Set(key, &cv)
+	c.schedule(key, &cv)
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := NewCache(&CacheConfig{MinTTL: 10, MaxTTL: 3600})
+	defer c.Close()
+
+	for _, cv := range []struct {
+		rrs    []string
+		expect time.Duration
+	}{
+		{rrs: []string{"a.tech. 30 IN A 1.1.1.1", "a.tech. 300 IN A 2.2.2.2"}, expect: 30 * time.Second},
+		{rrs: []string{"a.tech. 2 IN A 1.1.1.1"}, expect: 10 * time.Second},
+		{rrs: []string{"a.tech. 86400 IN A 1.1.1.1"}, expect: time.Hour},
+		{rrs: nil, expect: time.Duration(defaultTTL) * time.Second},
+	} {
+		c.Set("a.tech", newTestMsg("a.tech.", cv.rrs...))
+		val, _ := c.table.Peek("a.tech")
+		entry := val.(*cacheValue)
+		if ttl := entry.exp.Sub(entry.stored); ttl != cv.expect {
+			t.Errorf("%v: expect ttl %v, got %v", cv.rrs, cv.expect, ttl)
+		}
+	}
+}
+
+func TestCacheTTLDecrement(t *testing.T) {
+	c := NewCache(&CacheConfig{})
+	defer c.Close()
+
+	c.Set("a.tech", newTestMsg("a.tech.", "a.tech. 30 IN A 1.1.1.1", "a.tech. 300 IN A 2.2.2.2"))
+	age(c, "a.tech", 10*time.Second)
+
+	msg := c.Get("a.tech")
+	if msg == nil {
+		t.Fatal("expect cached answer")
+	}
+
+	for i, expect := range []uint32{20, 20} {
+		if ttl := msg.Answer[i].Header().Ttl; ttl != expect {
+			t.Errorf("answer %d: expect ttl %d, got %d", i, expect, ttl)
+		}
+	}
+
+	age(c, "a.tech", 21*time.Second)
+	if msg := c.Get("a.tech"); msg != nil {
+		t.Errorf("expect expired answer, got %v", msg)
+	}
+}
+
+func TestCacheZeroTTL(t *testing.T) {
+	c := NewCache(&CacheConfig{})
+	defer c.Close()
+
+	c.Set("a.tech", newTestMsg("a.tech.", "a.tech. 0 IN A 1.1.1.1"))
+	if msg := c.Get("a.tech"); msg != nil {
+		t.Errorf("expect zero ttl answer not cached, got %v", msg)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		qtype  uint16
+		do     bool
+		expect string
+	}{
+		{name: "WWW.Baidu.tech.", qtype: dns.TypeA, expect: "www.baidu.tech./A/IN"},
+		{name: "www.baidu.tech.", qtype: dns.TypeAAAA, expect: "www.baidu.tech./AAAA/IN"},
+		{name: "www.baidu.tech.", qtype: dns.TypeA, do: true, expect: "www.baidu.tech./A/IN/do"},
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, c.qtype)
+		if c.do {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+
+		if key := cacheKey(req); key != c.expect {
+			t.Errorf("expect key %s, got %s", c.expect, key)
+		}
+	}
+}
+
+func TestCacheAAndAAAA(t *testing.T) {
+	upper, stop := startUpper(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		q := req.Question[0]
+		data := "1.2.3.4"
+		if q.Qtype == dns.TypeAAAA {
+			data = "::1"
+		}
+		rr, _ := dns.NewRR(q.Name + " 300 IN " + dns.TypeToString[q.Qtype] + " " + data)
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})
+	defer stop()
+
+	cache := NewCache(&CacheConfig{})
+	defer cache.Close()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}}, cache, nil)
+	defer p.Stop()
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := &dns.Msg{}
+		req.SetQuestion("dual.example.com.", qtype)
+		if _, _, err := (&dns.Client{}).Exchange(req, p.listenAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := &dns.Msg{}
+		req.SetQuestion("dual.example.com.", qtype)
+		msg := cache.Get(cacheKey(req))
+		if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].Header().Rrtype != qtype {
+			t.Errorf("expect %s answer cached, got %v", dns.TypeToString[qtype], msg)
+		}
+	}
+}
+
+func TestCacheAllTypes(t *testing.T) {
+	var queries int32
+	upper, stop := startUpper(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		q := req.Question[0]
+		var rrs []string
+		switch q.Qtype {
+		case dns.TypeA:
+			rrs = []string{q.Name + " 300 IN CNAME edge.example.net.", "edge.example.net. 60 IN A 1.2.3.4"}
+		case dns.TypeMX:
+			rrs = []string{q.Name + " 300 IN MX 10 mail.example.net."}
+			rr, _ := dns.NewRR("mail.example.net. 300 IN A 5.6.7.8")
+			resp.Extra = append(resp.Extra, rr)
+		case dns.TypeTXT:
+			rrs = []string{q.Name + ` 300 IN TXT "v=spf1 -all"`}
+		}
+		for _, s := range rrs {
+			rr, _ := dns.NewRR(s)
+			resp.Answer = append(resp.Answer, rr)
+		}
+		ns, _ := dns.NewRR("example.com. 300 IN NS ns1.example.com.")
+		resp.Ns = append(resp.Ns, ns)
+		if opt := req.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		w.WriteMsg(resp)
+	})
+	defer stop()
+
+	cache := NewCache(&CacheConfig{})
+	defer cache.Close()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}}, cache, nil)
+	defer p.Stop()
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeMX, dns.TypeTXT} {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", qtype)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		first, _, err := (&dns.Client{}).Exchange(req, p.listenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := atomic.LoadInt32(&queries)
+		req = &dns.Msg{}
+		req.SetQuestion("WWW.example.com.", qtype)
+		second, _, err := (&dns.Client{}).Exchange(req, p.listenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if atomic.LoadInt32(&queries) != before {
+			t.Errorf("%s: expect answer from cache", dns.TypeToString[qtype])
+		}
+
+		if second.Id != req.Id || second.Question[0].Name != "WWW.example.com." {
+			t.Errorf("%s: expect replay for own query, got %v", dns.TypeToString[qtype], second)
+		}
+
+		if second.IsEdns0() != nil {
+			t.Errorf("%s: expect no OPT for a client without EDNS0", dns.TypeToString[qtype])
+		}
+
+		if len(second.Answer) != len(first.Answer) || len(second.Ns) != len(first.Ns) || len(second.Extra) != len(first.Extra)-1 {
+			t.Errorf("%s: expect all sections replayed, got %v", dns.TypeToString[qtype], second)
+		}
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := NewCache(&CacheConfig{NegativeTTL: 120})
+	defer c.Close()
+
+	soa := "tech. 3600 IN SOA ns.tech. admin.tech. 1 7200 900 1209600 %d"
+	for _, cv := range []struct {
+		rcode  int
+		soa    string
+		expect time.Duration
+	}{
+		{rcode: dns.RcodeNameError, soa: fmt.Sprintf(soa, 60), expect: 60 * time.Second},
+		{rcode: dns.RcodeSuccess, soa: fmt.Sprintf(soa, 600), expect: 120 * time.Second},
+		{rcode: dns.RcodeNameError, soa: "", expect: 0},
+		{rcode: dns.RcodeServerFailure, soa: fmt.Sprintf(soa, 60), expect: 0},
+	} {
+		msg := newTestMsg("nx.tech.")
+		msg.Rcode = cv.rcode
+		if cv.soa != "" {
+			rr, _ := dns.NewRR(cv.soa)
+			msg.Ns = append(msg.Ns, rr)
+		}
+
+		if !cacheable(msg) {
+			if cv.expect != 0 {
+				t.Errorf("%s %q: expect cacheable", dns.RcodeToString[cv.rcode], cv.soa)
+			}
+			continue
+		}
+
+		c.Set("nx.tech", msg)
+		val, ok := c.table.Peek("nx.tech")
+		if !ok {
+			t.Fatalf("%s: expect cached", dns.RcodeToString[cv.rcode])
+		}
+
+		entry := val.(*cacheValue)
+		if ttl := entry.exp.Sub(entry.stored); ttl != cv.expect {
+			t.Errorf("%s: expect ttl %v, got %v", dns.RcodeToString[cv.rcode], cv.expect, ttl)
+		}
+
+		if got := c.Get("nx.tech"); got == nil || got.Rcode != cv.rcode || got.Ns[0].Header().Ttl > uint32(cv.expect/time.Second) {
+			t.Errorf("%s: unexpected replay %v", dns.RcodeToString[cv.rcode], got)
+		}
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	c := NewCache(&CacheConfig{StaleTTL: 60})
+	defer c.Close()
+
+	c.Set("a.tech", newTestMsg("a.tech.", "a.tech. 30 IN A 1.1.1.1"))
+	age(c, "a.tech", 40*time.Second)
+
+	if msg := c.Get("a.tech"); msg != nil {
+		t.Errorf("expect expired entry missed, got %v", msg)
+	}
+
+	msg := c.GetStale("a.tech")
+	if msg == nil || len(msg.Answer) != 1 {
+		t.Fatalf("expect stale answer, got %v", msg)
+	}
+	if ttl := msg.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Errorf("expect stale ttl %d, got %d", staleAnswerTTL, ttl)
+	}
+
+	age(c, "a.tech", 60*time.Second)
+	if msg := c.GetStale("a.tech"); msg != nil {
+		t.Errorf("expect entry dropped after stale_ttl, got %v", msg)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := NewCache(&CacheConfig{Prefetch: 10})
+	defer c.Close()
+
+	refreshed := map[string]*dns.Msg{}
+	c.SetRefresher(func(key string, req *dns.Msg) {
+		refreshed[key] = req
+	})
+
+	now := time.Now()
+	item := func(key string, stored, accessed time.Duration) Item {
+		cv := &cacheValue{
+			msg:    newTestMsg("a.tech.", "a.tech. 300 IN A 1.1.1.1"),
+			stored: now.Add(-stored),
+			exp:    now.Add(-stored + 300*time.Second),
+		}
+		return Item{Key: key, Value: cv, Accessed: now.Add(-accessed)}
+	}
+
+	items := []Item{
+		item("hot/A/IN/do", 280*time.Second, 5*time.Second),
+		item("cold", 280*time.Second, 270*time.Second),
+		item("fresh", 100*time.Second, 0),
+		item("expired", 301*time.Second, 0),
+	}
+
+	if n := c.prefetchItems(items, now); n != 1 {
+		t.Errorf("expect 1 prefetched, got %d", n)
+	}
+
+	req, ok := refreshed["hot/A/IN/do"]
+	if !ok || len(refreshed) != 1 {
+		t.Fatalf("expect only hot prefetched, got %v", refreshed)
+	}
+
+	if req.Question[0].Name != "a.tech." || req.Question[0].Qtype != dns.TypeA {
+		t.Errorf("unexpected question %v", req.Question[0])
+	}
+	if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("expect DO bit kept")
+	}
+}
+
+func TestCachePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &CacheConfig{PersistPath: filepath.Join(dir, "cache.db")}
+	c := NewCache(cfg)
+	c.Set("fresh", newTestMsg("fresh.tech.", "fresh.tech. 300 IN A 1.1.1.1"))
+	c.Set("expired", newTestMsg("expired.tech.", "expired.tech. 30 IN A 2.2.2.2"))
+	age(c, "fresh", 100*time.Second)
+	age(c, "expired", time.Minute)
+	c.Close()
+
+	c = NewCache(cfg)
+	defer c.Close()
+
+	msg := c.Get("fresh")
+	if msg == nil || len(msg.Answer) != 1 {
+		t.Fatalf("expect fresh entry loaded, got %v", msg)
+	}
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("expect remaining ttl 200, got %d", ttl)
+	}
+
+	if _, ok := c.table.Peek("expired"); ok {
+		t.Error("expect expired entry not loaded")
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	c := NewCache(&CacheConfig{StaleTTL: 10})
+	defer c.Close()
+
+	c.Set("expired", newTestMsg("expired.tech.", "expired.tech. 30 IN A 1.1.1.1"))
+	c.Set("stale", newTestMsg("stale.tech.", "stale.tech. 30 IN A 1.1.1.1"))
+	c.Set("fresh", newTestMsg("fresh.tech.", "fresh.tech. 30 IN A 1.1.1.1"))
+	age(c, "expired", time.Minute)
+	age(c, "stale", 35*time.Second)
+
+	// an expired entry set again is not deleted by its old schedule
+	age(c, "fresh", time.Minute)
+	c.Set("fresh", newTestMsg("fresh.tech.", "fresh.tech. 30 IN A 1.1.1.1"))
+
+	if n := c.expire(time.Now()); n != 1 {
+		t.Errorf("expect 1 deleted, got %d", n)
+	}
+
+	for key, expect := range map[string]bool{"expired": false, "stale": true, "fresh": true} {
+		if _, ok := c.table.Peek(key); ok != expect {
+			t.Errorf("%s: expect cached %v", key, expect)
+		}
+	}
+}
+
+func TestCacheExpiryBounded(t *testing.T) {
+	c := NewCache(&CacheConfig{Cap: 10, Prefetch: 10})
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		c.Set("same", newTestMsg("same.tech.", "same.tech. 300 IN A 1.1.1.1"))
+		key := fmt.Sprintf("%d.tech", i)
+		c.Set(key, newTestMsg(key+".", key+". 300 IN A 1.1.1.1"))
+	}
+	if n := c.expiry.len(); n != 10 {
+		t.Errorf("expect one expiry per cached entry, got %d", n)
+	}
+	if n := c.prefetches.len(); n != 10 {
+		t.Errorf("expect one prefetch per cached entry, got %d", n)
+	}
+
+	c.Purge("same.tech", false)
+	if n := c.expiry.len(); n != 9 {
+		t.Errorf("expect purged entry unscheduled, got %d", n)
+	}
+
+	c.Flush()
+	if n := c.expiry.len() + c.prefetches.len(); n != 0 {
+		t.Errorf("expect flushed entries unscheduled, got %d", n)
+	}
+
+	c.Set("same", newTestMsg("same.tech.", "same.tech. 300 IN A 1.1.1.1"))
+	if n := c.expiry.len(); n != 1 {
+		t.Errorf("expect entry set after flush scheduled, got %d", n)
+	}
+}
+
+func TestCachePrefetchDue(t *testing.T) {
+	c := NewCache(&CacheConfig{Prefetch: 10})
+	defer c.Close()
+
+	refreshed := make(chan string, 10)
+	c.SetRefresher(func(key string, req *dns.Msg) {
+		refreshed <- key
+	})
+
+	c.Set("hot", newTestMsg("hot.tech.", "hot.tech. 300 IN A 1.1.1.1"))
+	c.Set("fresh", newTestMsg("fresh.tech.", "fresh.tech. 300 IN A 1.1.1.1"))
+	age(c, "hot", 280*time.Second)
+
+	select {
+	case key := <-refreshed:
+		if key != "hot" {
+			t.Errorf("expect hot prefetched, got %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect hot prefetched")
+	}
+
+	select {
+	case key := <-refreshed:
+		t.Errorf("expect hot prefetched once, got %s", key)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestCachePrefetchShortTTL(t *testing.T) {
+	// the prefetch window of a 2s answer opens long before the gc interval
+	c := NewCache(&CacheConfig{Prefetch: 50, Interval: 60})
+	defer c.Close()
+
+	refreshed := make(chan time.Time, 10)
+	c.SetRefresher(func(key string, req *dns.Msg) {
+		refreshed <- time.Now()
+	})
+
+	c.Set("short", newTestMsg("short.tech.", "short.tech. 2 IN A 1.1.1.1"))
+	val, _ := c.table.Peek("short")
+	exp := val.(*cacheValue).exp
+
+	time.Sleep(1100 * time.Millisecond)
+	c.Get("short")
+
+	select {
+	case at := <-refreshed:
+		if at.After(exp) {
+			t.Errorf("expect prefetch before expiry, %v late", at.Sub(exp))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect short ttl answer prefetched")
+	}
+}
+
+func TestCacheShardsClamped(t *testing.T) {
+	c := NewCache(&CacheConfig{Cap: 4, Shards: 16})
+	defer c.Close()
+	if s, ok := c.table.(*ShardedLRUCache); !ok || len(s.shards) != 4 {
+		t.Errorf("expect 4 shards of one entry, got %T %v", c.table, c.table.StatsJSON())
+	}
+
+	c = NewCache(&CacheConfig{Cap: 100000, CapUnit: "bytes", Shards: 8})
+	defer c.Close()
+	if _, ok := c.table.(*LRUCache); !ok {
+		t.Errorf("expect a single lru for 100000 bytes, got %T", c.table)
+	}
+}
+
+func TestCacheBytes(t *testing.T) {
+	c := NewCache(&CacheConfig{Cap: 700, CapUnit: "bytes"})
+	defer c.Close()
+
+	txt := "big.tech. 300 IN TXT \"" + strings.Repeat("x", 250) + "\""
+	small := newTestMsg("small.tech.", "small.tech. 300 IN A 1.1.1.1")
+	big := newTestMsg("big.tech.", txt, txt)
+	c.Set("small", small)
+	c.Set("big", big)
+	if size := c.table.Size(); size != int64(small.Len()+big.Len()) {
+		t.Errorf("expect size %d, got %d", small.Len()+big.Len(), size)
+	}
+
+	huge := newTestMsg("huge.tech.", txt, txt, txt)
+	c.Set("huge", huge)
+	if _, ok := c.table.Peek("huge"); ok {
+		t.Errorf("expect %d bytes answer not cached in 700 bytes", huge.Len())
+	}
+	for _, key := range []string{"small", "big"} {
+		if _, ok := c.table.Peek(key); !ok {
+			t.Errorf("expect %s kept", key)
+		}
+	}
+	if c.expiry.len() != 2 {
+		t.Errorf("expect 2 scheduled, got %d", c.expiry.len())
+	}
+}
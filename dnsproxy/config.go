@@ -19,6 +19,7 @@ type Config struct {
 	Proxy  *ProxyConfig  `toml:"dns"`
 	Policy *PolicyConfig `toml:"policy"`
 	Cache  *CacheConfig  `toml:"cache"`
+	Admin  *AdminConfig  `toml:"admin"`
 	Log    *LogConfig    `toml:"log"`
 }
 
@@ -0,0 +1,85 @@
+package dnsproxy
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// flightCall is an upstream exchange in progress, waited for by the
+// queries asking the same question meanwhile.
+type flightCall struct {
+	wg   sync.WaitGroup
+	resp *dns.Msg
+	up   *trackedUpstream
+	err  error
+	dups int
+}
+
+// flightGroup coalesces identical queries missing the cache at the same
+// time into a single upstream exchange.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do runs fn once for the concurrent callers of key and hands its result
+// to all of them. shared reports whether the result went to more than one
+// caller, the response must not be modified then.
+func (g *flightGroup) do(key string, fn func() (*dns.Msg, *trackedUpstream, error)) (resp *dns.Msg, up *trackedUpstream, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.resp, c.up, c.err, true
+	}
+
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.resp, c.up, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	shared = c.dups > 0
+	g.mu.Unlock()
+	c.wg.Done()
+
+	return c.resp, c.up, c.err, shared
+}
+
+// flightKey tells apart the queries that may share an exchange. Besides
+// the question and the DO bit, queries with and without EDNS are kept
+// apart, an answer to the latter is sized and built for plain dns.
+func flightKey(req *dns.Msg) string {
+	key := cacheKey(req)
+	if req.IsEdns0() != nil {
+		key += "/edns"
+	}
+	return key
+}
+
+// resolve exchanges req with upper, sharing the exchange with the
+// identical queries in flight. Each caller gets its own copy of a shared
+// answer, made the reply to its query as a cached answer is. leader is
+// false for the callers that waited for another one's exchange.
+func (p *Proxy) resolve(upper []*trackedUpstream, req *dns.Msg) (resp *dns.Msg, up *trackedUpstream, leader bool, err error) {
+	var shared bool
+	resp, up, err, shared = p.flights.do(flightKey(req), func() (*dns.Msg, *trackedUpstream, error) {
+		leader = true
+		return p.exchange(upper, req)
+	})
+	if err != nil || !shared {
+		return resp, up, leader, err
+	}
+
+	resp = resp.Copy()
+	replyTo(resp, req)
+	return resp, up, leader, nil
+}
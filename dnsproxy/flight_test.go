@@ -0,0 +1,99 @@
+package dnsproxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCoalesceQueries(t *testing.T) {
+	var queries int32
+	upper, stop := startUpper(t, delayed(300*time.Millisecond, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		answerA("1.2.3.4")(w, req)
+	}))
+	defer stop()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}, Concurrency: 20}, nil, nil)
+	defer p.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := &dns.Msg{}
+			req.SetQuestion("same.example.com.", dns.TypeA)
+			resp, _, err := (&dns.Client{}).Exchange(req, p.listenAddr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if resp.Id != req.Id || len(resp.Answer) != 1 {
+				t.Errorf("unexpected response %v", resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("expect 1 upstream query, got %d", n)
+	}
+}
+
+func TestCoalesceReplyPerQuery(t *testing.T) {
+	var queries int32
+	upper, stop := startUpper(t, delayed(300*time.Millisecond, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		answerManyA(1)(w, req)
+	}))
+	defer stop()
+	p := NewProxy(&ProxyConfig{Upper: []string{upper}}, nil, nil)
+
+	leader := &dns.Msg{}
+	leader.SetQuestion("same.example.com.", dns.TypeA)
+	leader.SetEdns0(4096, false)
+
+	// shares the exchange of leader, with flags of its own
+	follower := leader.Copy()
+	follower.Id = dns.Id()
+	follower.RecursionDesired = false
+	follower.CheckingDisabled = true
+
+	// asks without EDNS, it must not get an OPT record
+	plain := &dns.Msg{}
+	plain.SetQuestion("same.example.com.", dns.TypeA)
+
+	resps := make([]*dns.Msg, 3)
+	var wg sync.WaitGroup
+	for i, req := range []*dns.Msg{leader, follower, plain} {
+		wg.Add(1)
+		go func(i int, req *dns.Msg) {
+			defer wg.Done()
+			resp, _, _, err := p.resolve(p.upper, req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resps[i] = resp
+		}(i, req)
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("expect 2 upstream queries, got %d", n)
+	}
+
+	resp := resps[1]
+	if resp == nil || resp.Id != follower.Id || resp.RecursionDesired || !resp.CheckingDisabled {
+		t.Errorf("expect follower flags in its answer, got %v", resp)
+	}
+	if resp := resps[2]; resp == nil || resp.IsEdns0() != nil {
+		t.Errorf("expect plain answer without OPT, got %v", resp)
+	}
+}
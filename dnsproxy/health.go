@@ -0,0 +1,141 @@
+package dnsproxy
+
+import (
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
+)
+
+var (
+	defaultMaxFails       = 3
+	defaultFailTimeout    = 30
+	defaultHealthInterval = 10
+)
+
+// HealthConfig controls when an upstream is considered down. An upstream
+// failing max_fails queries in a row is skipped, and tried again by a live
+// query after fail_timeout seconds, or as soon as an active probe for
+// domain succeeds when domain is set.
+type HealthConfig struct {
+	MaxFails    int    `toml:"max_fails"`
+	FailTimeout int    `toml:"fail_timeout"`
+	Domain      string `toml:"domain"`
+	Interval    int    `toml:"interval"`
+}
+
+type healthOptions struct {
+	maxFails    int
+	failTimeout time.Duration
+	domain      string
+	interval    time.Duration
+}
+
+func newHealthOptions(cfg *HealthConfig) *healthOptions {
+	if cfg == nil {
+		cfg = &HealthConfig{}
+	}
+
+	maxFails := cfg.MaxFails
+	if maxFails <= 0 {
+		maxFails = defaultMaxFails
+	}
+
+	failTimeout := cfg.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = defaultFailTimeout
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+
+	domain := ""
+	if cfg.Domain != "" {
+		domain = dns.Fqdn(cfg.Domain)
+	}
+
+	return &healthOptions{
+		maxFails:    maxFails,
+		failTimeout: time.Second * time.Duration(failTimeout),
+		domain:      domain,
+		interval:    time.Second * time.Duration(interval),
+	}
+}
+
+// report updates the health of u with the result of an exchange.
+func (u *trackedUpstream) report(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.lastTried = time.Now()
+	if err == nil {
+		if u.down {
+			logs.Info("upper %s is up again", u)
+		}
+		u.fails = 0
+		u.down = false
+		return
+	}
+
+	u.fails++
+	if !u.down && u.fails >= u.health.maxFails {
+		logs.Warn("upper %s is down after %d failures, last error: %v", u, u.fails, err)
+		u.down = true
+	}
+}
+
+// Available reports whether queries should be sent to u: it is up, or it
+// has been left alone for fail_timeout and may be tried again.
+func (u *trackedUpstream) Available() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return !u.down || time.Since(u.lastTried) >= u.health.failTimeout
+}
+
+// available filters out the upstreams that are down, all of ups are kept if
+// none is available.
+func available(ups []*trackedUpstream) []*trackedUpstream {
+	alive := make([]*trackedUpstream, 0, len(ups))
+	for _, up := range ups {
+		if up.Available() {
+			alive = append(alive, up)
+		}
+	}
+
+	if len(alive) == 0 {
+		return ups
+	}
+	return alive
+}
+
+// probe queries the health domain on every upstream periodically, so that
+// a down upstream recovers without waiting for a live query.
+func (p *Proxy) probe() {
+	for {
+		select {
+		case <-p.done:
+			return
+
+		case <-time.After(p.health.interval):
+			p.upsMu.Lock()
+			ups := make([]*trackedUpstream, 0, len(p.upstreams))
+			for _, up := range p.upstreams {
+				ups = append(ups, up)
+			}
+			p.upsMu.Unlock()
+
+			for _, up := range ups {
+				go func(up *trackedUpstream) {
+					req := &dns.Msg{}
+					req.SetQuestion(p.health.domain, dns.TypeA)
+					if _, err := up.Exchange(req); err != nil {
+						logs.Debug("probe upper %s fail: %v", up, err)
+					}
+				}(up)
+			}
+		}
+	}
+}
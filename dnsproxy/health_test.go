@@ -0,0 +1,176 @@
+package dnsproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealthFailover(t *testing.T) {
+	dead, stopDead := startDeadUpper(t)
+	defer stopDead()
+	live, stopLive := startUpper(t, answerA("1.2.3.4"))
+	defer stopLive()
+
+	p := NewProxy(&ProxyConfig{
+		Upper:   []string{dead, live},
+		Timeout: 1,
+		Health:  &HealthConfig{MaxFails: 2, FailTimeout: 60},
+	}, nil, nil)
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, _, err := p.exchange(p.upper, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if p.upper[0].Available() {
+		t.Fatalf("expect %s down after 2 failures", dead)
+	}
+
+	start := time.Now()
+	if _, up, err := p.exchange(p.upper, req); err != nil || up.String() != live {
+		t.Fatalf("expect answer from %s, got %v %v", live, up, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expect down upper skipped, took %v", elapsed)
+	}
+
+	p.upper[0].report(nil)
+	if !p.upper[0].Available() {
+		t.Errorf("expect %s up after a success", dead)
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	live, stop := startUpper(t, answerA("1.2.3.4"))
+	defer stop()
+
+	p := NewProxy(&ProxyConfig{
+		Upper:  []string{live},
+		Health: &HealthConfig{MaxFails: 1, FailTimeout: 60, Domain: "health.example.com", Interval: 1},
+	}, nil, nil)
+	defer p.Stop()
+
+	up := p.upper[0]
+	up.report(errExchangeTimeout)
+	if up.Available() {
+		t.Fatal("expect upper down")
+	}
+
+	go p.probe()
+	for i := 0; i < 30 && !up.Available(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if !up.Available() {
+		t.Error("expect upper recovered by probe")
+	}
+}
+
+func TestHealthBadRcode(t *testing.T) {
+	refuse := func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(resp)
+	}
+	upper, stop := startUpper(t, refuse)
+	defer stop()
+
+	p := NewProxy(&ProxyConfig{
+		Upper:  []string{upper},
+		Health: &HealthConfig{MaxFails: 1, FailTimeout: 60, Domain: "health.example.com", Interval: 1},
+	}, nil, nil)
+	defer p.Stop()
+
+	up := p.upper[0]
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	if resp, err := up.Exchange(req); err != nil || resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expect REFUSED answer, got %v %v", resp, err)
+	}
+	if up.Available() {
+		t.Fatal("expect upper down after a REFUSED answer")
+	}
+
+	// a probe answered with a bad rcode must not revive it
+	go p.probe()
+	time.Sleep(1500 * time.Millisecond)
+	if up.Available() {
+		t.Error("expect upper still down after a REFUSED probe")
+	}
+}
+
+func TestHealthPruneReloaded(t *testing.T) {
+	var probes [2]int32
+	counting := func(i int) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			if req.Question[0].Name == "health.example.com." {
+				atomic.AddInt32(&probes[i], 1)
+			}
+			answerA("1.2.3.4")(w, req)
+		}
+	}
+	kept, stopKept := startUpper(t, counting(0))
+	defer stopKept()
+	gone, stopGone := startUpper(t, counting(1))
+	defer stopGone()
+	global, stopGlobal := startUpper(t, answerA("1.2.3.4"))
+	defer stopGlobal()
+
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := func(domain, addr string) string {
+		return "server=/" + domain + "/" + strings.Replace(addr, ":", "#", 1) + "\n"
+	}
+	file := filepath.Join(dir, "policy.conf")
+	ioutil.WriteFile(file, []byte(server("kept.tech", kept)+server("gone.tech", gone)), 0644)
+
+	pl := NewPolicy(&PolicyConfig{Path: dir})
+	pl.Load()
+	p := NewProxy(&ProxyConfig{
+		Upper:  []string{global},
+		Health: &HealthConfig{Domain: "health.example.com", Interval: 1},
+	}, nil, pl)
+	defer p.Stop()
+
+	for _, domain := range []string{"kept.tech", "gone.tech"} {
+		if ups := p.upstreamsFor(domain); len(ups) != 1 {
+			t.Fatalf("expect policy upper for %s, got %v", domain, ups)
+		}
+	}
+
+	ioutil.WriteFile(file, []byte(server("kept.tech", kept)), 0644)
+	if err := pl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.upsMu.Lock()
+	_, hasGone := p.upstreams[gone]
+	n := len(p.upstreams)
+	p.upsMu.Unlock()
+	if hasGone || n != 2 {
+		t.Errorf("expect %s pruned, %d upstreams left", gone, n)
+	}
+
+	go p.probe()
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt32(&probes[1]); n != 0 {
+		t.Errorf("expect pruned upper not probed, got %d probes", n)
+	}
+	if n := atomic.LoadInt32(&probes[0]); n == 0 {
+		t.Error("expect kept upper probed")
+	}
+}
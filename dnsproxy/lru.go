@@ -44,6 +44,10 @@ type LRUCache struct {
 	size      int64
 	capacity  int64
 	evictions int64
+
+	// onEvicted is called with the entries evicted for capacity, and with
+	// those dropped by Clear
+	onEvicted func(key string, value Value)
 }
 
 // Value is the interface values that go into LRUCache need to satisfy
@@ -55,8 +59,9 @@ type Value interface {
 
 // Item is what is stored in the cache
 type Item struct {
-	Key   string
-	Value Value
+	Key      string
+	Value    Value
+	Accessed time.Time
 }
 
 type entry struct {
@@ -101,6 +106,18 @@ func (lru *LRUCache) Peek(key string) (v Value, ok bool) {
 	return element.Value.(*entry).value, true
 }
 
+// Accessed returns when the entry of key was last set or got.
+func (lru *LRUCache) Accessed(key string) (t time.Time, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[key]
+	if element == nil {
+		return time.Time{}, false
+	}
+	return element.Value.(*entry).timeAccessed, true
+}
+
 // Set sets a value in the cache.
 func (lru *LRUCache) Set(key string, value Value) {
 	lru.mu.Lock()
@@ -142,11 +159,43 @@ func (lru *LRUCache) Delete(key string) bool {
 	return true
 }
 
+// DeleteIf removes the entry of key if fn, called under the cache lock,
+// returns true for its value, and returns if the entry was removed.
+func (lru *LRUCache) DeleteIf(key string, fn func(Value) bool) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[key]
+	if element == nil || !fn(element.Value.(*entry).value) {
+		return false
+	}
+
+	lru.list.Remove(element)
+	delete(lru.table, key)
+	lru.size -= element.Value.(*entry).size
+	return true
+}
+
+// SetOnEvicted sets the function called, under the cache lock, with the
+// entries evicted when the capacity is exceeded or dropped by Clear.
+func (lru *LRUCache) SetOnEvicted(fn func(key string, value Value)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.onEvicted = fn
+}
+
 // Clear will clear the entire cache.
 func (lru *LRUCache) Clear() {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
+	if lru.onEvicted != nil {
+		for e := lru.list.Front(); e != nil; e = e.Next() {
+			v := e.Value.(*entry)
+			lru.onEvicted(v.key, v.value)
+		}
+	}
+
 	lru.list.Init()
 	lru.table = make(map[string]*list.Element)
 	lru.size = 0
@@ -203,6 +252,12 @@ func (lru *LRUCache) Capacity() int64 {
 	return lru.capacity
 }
 
+// KeyCapacity returns the capacity the entry of key is held in, the
+// cache maximum capacity.
+func (lru *LRUCache) KeyCapacity(key string) int64 {
+	return lru.Capacity()
+}
+
 // Evictions returns the eviction count.
 func (lru *LRUCache) Evictions() int64 {
 	lru.mu.Lock()
@@ -243,7 +298,7 @@ func (lru *LRUCache) Items() []Item {
 	items := make([]Item, 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
 		v := e.Value.(*entry)
-		items = append(items, Item{Key: v.key, Value: v.value})
+		items = append(items, Item{Key: v.key, Value: v.value, Accessed: v.timeAccessed})
 	}
 	return items
 }
@@ -280,5 +335,8 @@ func (lru *LRUCache) checkCapacity() {
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
 		lru.evictions++
+		if lru.onEvicted != nil {
+			lru.onEvicted(delValue.key, delValue.value)
+		}
 	}
 }
@@ -0,0 +1,199 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// ShardedLRUCache spreads its entries over independent LRUCache shards
+// selected by key hash, so that concurrent accesses to different keys do
+// not contend for one mutex. The least recently used entry is evicted per
+// shard, each shard holding an even part of the capacity.
+type ShardedLRUCache struct {
+	shards []*LRUCache
+}
+
+// NewShardedLRUCache creates a new empty cache of n shards sharing the
+// given capacity.
+func NewShardedLRUCache(n int, capacity int64) *ShardedLRUCache {
+	if n <= 0 {
+		n = 1
+	}
+
+	s := &ShardedLRUCache{shards: make([]*LRUCache, n)}
+	for i := range s.shards {
+		s.shards[i] = NewLRUCache(shardCapacity(capacity, n, i))
+	}
+	return s
+}
+
+// shardCapacity returns the part of capacity held by shard i of n.
+func shardCapacity(capacity int64, n, i int) int64 {
+	c := capacity / int64(n)
+	if int64(i) < capacity%int64(n) {
+		c++
+	}
+	return c
+}
+
+// shard returns the shard of key, picked with the FNV-1a hash of the key.
+func (s *ShardedLRUCache) shard(key string) *LRUCache {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+// Get returns a value from the cache, and marks the entry as most
+// recently used in its shard.
+func (s *ShardedLRUCache) Get(key string) (v Value, ok bool) {
+	return s.shard(key).Get(key)
+}
+
+// Peek returns a value from the cache without changing the LRU order.
+func (s *ShardedLRUCache) Peek(key string) (v Value, ok bool) {
+	return s.shard(key).Peek(key)
+}
+
+// Accessed returns when the entry of key was last set or got.
+func (s *ShardedLRUCache) Accessed(key string) (t time.Time, ok bool) {
+	return s.shard(key).Accessed(key)
+}
+
+// Set sets a value in the cache.
+func (s *ShardedLRUCache) Set(key string, value Value) {
+	s.shard(key).Set(key, value)
+}
+
+// SetIfAbsent will set the value in the cache if not present.
+func (s *ShardedLRUCache) SetIfAbsent(key string, value Value) {
+	s.shard(key).SetIfAbsent(key, value)
+}
+
+// Delete removes an entry from the cache, and returns if the entry existed.
+func (s *ShardedLRUCache) Delete(key string) bool {
+	return s.shard(key).Delete(key)
+}
+
+// DeleteIf removes the entry of key if fn returns true for its value.
+func (s *ShardedLRUCache) DeleteIf(key string, fn func(Value) bool) bool {
+	return s.shard(key).DeleteIf(key, fn)
+}
+
+// SetOnEvicted sets the function called with the entries evicted from
+// any shard.
+func (s *ShardedLRUCache) SetOnEvicted(fn func(key string, value Value)) {
+	for _, lru := range s.shards {
+		lru.SetOnEvicted(fn)
+	}
+}
+
+// Clear will clear the entire cache.
+func (s *ShardedLRUCache) Clear() {
+	for _, lru := range s.shards {
+		lru.Clear()
+	}
+}
+
+// SetCapacity will set the capacity of the cache, spread evenly over the
+// shards.
+func (s *ShardedLRUCache) SetCapacity(capacity int64) {
+	for i, lru := range s.shards {
+		lru.SetCapacity(shardCapacity(capacity, len(s.shards), i))
+	}
+}
+
+// Stats returns the stats of the shards added up, oldest is the oldest
+// access of all shards.
+func (s *ShardedLRUCache) Stats() (length, size, capacity, evictions int64, oldest time.Time) {
+	for _, lru := range s.shards {
+		l, sz, c, e, o := lru.Stats()
+		length += l
+		size += sz
+		capacity += c
+		evictions += e
+		if !o.IsZero() && (oldest.IsZero() || o.Before(oldest)) {
+			oldest = o
+		}
+	}
+	return
+}
+
+// StatsJSON returns stats as a JSON object in a string.
+func (s *ShardedLRUCache) StatsJSON() string {
+	if s == nil {
+		return "{}"
+	}
+	l, sz, c, e, o := s.Stats()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v, \"Evictions\": %v, \"OldestAccess\": \"%v\", \"Shards\": %v}", l, sz, c, e, o, len(s.shards))
+}
+
+// Length returns how many elements are in the cache
+func (s *ShardedLRUCache) Length() int64 {
+	var n int64
+	for _, lru := range s.shards {
+		n += lru.Length()
+	}
+	return n
+}
+
+// Size returns the sum of the objects' Size() method.
+func (s *ShardedLRUCache) Size() int64 {
+	var n int64
+	for _, lru := range s.shards {
+		n += lru.Size()
+	}
+	return n
+}
+
+// Capacity returns the cache maximum capacity.
+func (s *ShardedLRUCache) Capacity() int64 {
+	var n int64
+	for _, lru := range s.shards {
+		n += lru.Capacity()
+	}
+	return n
+}
+
+// KeyCapacity returns the capacity of the shard of key.
+func (s *ShardedLRUCache) KeyCapacity(key string) int64 {
+	return s.shard(key).Capacity()
+}
+
+// Evictions returns the eviction count.
+func (s *ShardedLRUCache) Evictions() int64 {
+	var n int64
+	for _, lru := range s.shards {
+		n += lru.Evictions()
+	}
+	return n
+}
+
+// Oldest returns the access time of the oldest element in the cache,
+// or a IsZero() time if cache is empty.
+func (s *ShardedLRUCache) Oldest() (oldest time.Time) {
+	_, _, _, _, oldest = s.Stats()
+	return
+}
+
+// Keys returns all the keys for the cache, ordered from most recently
+// used to last recently used within each shard.
+func (s *ShardedLRUCache) Keys() []string {
+	var keys []string
+	for _, lru := range s.shards {
+		keys = append(keys, lru.Keys()...)
+	}
+	return keys
+}
+
+// Items returns all the values for the cache, ordered from most recently
+// used to last recently used within each shard.
+func (s *ShardedLRUCache) Items() []Item {
+	var items []Item
+	for _, lru := range s.shards {
+		items = append(items, lru.Items()...)
+	}
+	return items
+}
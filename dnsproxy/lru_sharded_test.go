@@ -0,0 +1,90 @@
+package dnsproxy
+
+import (
+	"strconv"
+	"testing"
+)
+
+type sizedValue int
+
+func (v sizedValue) Size() int {
+	return int(v)
+}
+
+func TestShardedLRUCache(t *testing.T) {
+	s := NewShardedLRUCache(4, 10)
+	if c := s.Capacity(); c != 10 {
+		t.Errorf("expect capacity 10, got %d", c)
+	}
+
+	for i := 0; i < 100; i++ {
+		s.Set(strconv.Itoa(i), sizedValue(1))
+	}
+
+	length, size, capacity, evictions, oldest := s.Stats()
+	if length > 10 || size != length || capacity != 10 || evictions != 100-length || oldest.IsZero() {
+		t.Errorf("unexpected stats %d %d %d %d %v", length, size, capacity, evictions, oldest)
+	}
+
+	if len(s.Items()) != int(length) || len(s.Keys()) != int(length) {
+		t.Errorf("expect %d items", length)
+	}
+
+	s.Set("key", sizedValue(1))
+	if v, ok := s.Get("key"); !ok || v != sizedValue(1) {
+		t.Errorf("expect key set, got %v", v)
+	}
+	if !s.Delete("key") {
+		t.Error("expect key deleted")
+	}
+	if _, ok := s.Peek("key"); ok {
+		t.Error("expect key missing")
+	}
+
+	s.Clear()
+	if s.Length() != 0 || s.Size() != 0 {
+		t.Errorf("expect empty cache, got %s", s.StatsJSON())
+	}
+}
+
+var benchKeys = func() []string {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = "name" + strconv.Itoa(i) + ".example.com./A/IN"
+	}
+	return keys
+}()
+
+// benchmarkTable runs a mix of 9 gets for 1 set from parallel goroutines,
+// run it with -cpu 1,4,16 to see how it scales.
+func benchmarkTable(b *testing.B, table cacheTable) {
+	for _, key := range benchKeys {
+		table.Set(key, sizedValue(1))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := benchKeys[i%len(benchKeys)]
+			if i%10 == 0 {
+				table.Set(key, sizedValue(1))
+			} else {
+				table.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkLRUCache(b *testing.B) {
+	benchmarkTable(b, NewLRUCache(int64(len(benchKeys))))
+}
+
+func BenchmarkShardedLRUCache(b *testing.B) {
+	for _, n := range []int{4, 16, 64} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			benchmarkTable(b, NewShardedLRUCache(n, int64(len(benchKeys))))
+		})
+	}
+}
@@ -2,6 +2,12 @@ package dnsproxy
 
 import (
 	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	logs "github.com/jursonmo/beelogs"
 )
@@ -13,6 +19,7 @@ func Main(path string) {
 		return
 	}
 
+	rand.Seed(time.Now().UnixNano())
 	logs.Init(conf.Log.Path, conf.Log.Level, conf.Log.MaxDay)
 	logs.Info("load config: %s", conf.String())
 
@@ -28,5 +35,58 @@ func Main(path string) {
 	}
 
 	proxy := NewProxy(conf.Proxy, cache, policy)
-	logs.Error("run proxy error: %v", proxy.Run())
+	if proxy == nil {
+		return
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- proxy.Run()
+	}()
+
+	if conf.Admin != nil && cache != nil {
+		admin := NewAdminServer(conf.Admin, cache)
+		defer admin.Close()
+
+		logs.Info("admin api running on %s", admin.Addr)
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				logs.Error("run admin api error: %v", err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if policy != nil {
+		go policy.Watch(done)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for running := true; running; {
+		select {
+		case err := <-errc:
+			logs.Error("run proxy error: %v", err)
+			running = false
+
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				if policy != nil {
+					logs.Info("recv signal %v, reload policy", sig)
+					policy.Reload()
+				}
+				continue
+			}
+
+			logs.Info("recv signal %v, exit", sig)
+			proxy.Stop()
+			running = false
+		}
+	}
+
+	if cache != nil {
+		cache.Close()
+	}
 }
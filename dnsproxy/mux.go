@@ -0,0 +1,229 @@
+package dnsproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
+)
+
+var (
+	errExchangeTimeout  = errors.New("exchange timeout")
+	errNotResponse      = errors.New("not a response")
+	errQuestionMismatch = errors.New("question mismatch")
+	errConnClosed       = errors.New("connection closed")
+)
+
+// matchResponse checks that resp answers the question of req. The name is
+// compared case insensitively, upstreams may answer with 0x20 encoding.
+func matchResponse(req, resp *dns.Msg) error {
+	if !resp.Response {
+		return errNotResponse
+	}
+
+	if len(resp.Question) != len(req.Question) {
+		return errQuestionMismatch
+	}
+
+	for i, q := range req.Question {
+		rq := resp.Question[i]
+		if rq.Qtype != q.Qtype || rq.Qclass != q.Qclass || !strings.EqualFold(rq.Name, q.Name) {
+			return errQuestionMismatch
+		}
+	}
+	return nil
+}
+
+// muxConn multiplexes queries over one long-lived connection to an
+// upstream, either a stream (tcp, tls) or a connected udp socket. Each
+// outgoing query gets an id unique on the connection, answers are
+// dispatched back to the waiting Exchange by that id and may arrive in
+// any order. Answers whose question does not match the query, or
+// datagrams from another address, are dropped and the query keeps waiting
+// for the genuine answer until it times out.
+type muxConn struct {
+	conn    net.Conn
+	packet  bool
+	timeout time.Duration
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]*pendingQuery
+	err     error
+	done    chan struct{}
+}
+
+func newMuxConn(conn net.Conn, timeout time.Duration) *muxConn {
+	_, packet := conn.(net.PacketConn)
+	m := &muxConn{
+		conn:    conn,
+		packet:  packet,
+		timeout: timeout,
+		pending: make(map[uint16]*pendingQuery),
+		done:    make(chan struct{}),
+	}
+
+	go m.readLoop()
+	return m
+}
+
+type pendingQuery struct {
+	req *dns.Msg
+	ch  chan *dns.Msg
+}
+
+func (m *muxConn) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+
+	id := dns.Id()
+	for _, ok := m.pending[id]; ok; _, ok = m.pending[id] {
+		id = dns.Id()
+	}
+	m.pending[id] = &pendingQuery{req: req, ch: ch}
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+	}()
+
+	out := *req
+	out.Id = id
+	buf, err := out.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	m.wmu.Lock()
+	m.conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	err = m.writeMsg(buf)
+	m.wmu.Unlock()
+	if err != nil {
+		m.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-ch:
+		resp.Id = req.Id
+		return resp, nil
+
+	case <-m.done:
+		return nil, m.closeErr()
+
+	case <-timer.C:
+		return nil, errExchangeTimeout
+	}
+}
+
+// Closed reports whether the connection failed and must be replaced.
+func (m *muxConn) Closed() bool {
+	return m.closeErr() != nil
+}
+
+func (m *muxConn) Close() {
+	m.close(errConnClosed)
+}
+
+func (m *muxConn) closeErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *muxConn) close(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return
+	}
+
+	m.err = err
+	close(m.done)
+	m.conn.Close()
+}
+
+func (m *muxConn) writeMsg(buf []byte) error {
+	if m.packet {
+		_, err := m.conn.Write(buf)
+		return err
+	}
+	return writeTCPMsg(m.conn, buf)
+}
+
+// readMsg reads the next message, rbuf is reused for datagrams.
+func (m *muxConn) readMsg(rbuf []byte) ([]byte, error) {
+	if !m.packet {
+		return readTCPMsg(m.conn)
+	}
+
+	for {
+		nr, addr, err := m.conn.(net.PacketConn).ReadFrom(rbuf)
+		if err != nil {
+			return nil, err
+		}
+
+		if addr.String() != m.conn.RemoteAddr().String() {
+			logs.Warn("drop datagram from %s, expect %s", addr, m.conn.RemoteAddr())
+			continue
+		}
+		return rbuf[:nr], nil
+	}
+}
+
+func (m *muxConn) readLoop() {
+	var rbuf []byte
+	if m.packet {
+		rbuf = make([]byte, dns.MaxMsgSize)
+	}
+
+	for {
+		buf, err := m.readMsg(rbuf)
+		if err != nil {
+			m.close(err)
+			return
+		}
+
+		resp := &dns.Msg{}
+		if err := resp.Unpack(buf); err != nil {
+			logs.Warn("invalid dns response from %s: %v", m.conn.RemoteAddr(), err)
+			continue
+		}
+
+		m.mu.Lock()
+		pq, ok := m.pending[resp.Id]
+		if ok {
+			if err = matchResponse(pq.req, resp); err == nil {
+				delete(m.pending, resp.Id)
+			}
+		}
+		m.mu.Unlock()
+
+		if !ok {
+			logs.Debug("drop unexpected response %d from %s", resp.Id, m.conn.RemoteAddr())
+			continue
+		}
+
+		if err != nil {
+			logs.Warn("drop response %d from %s: %v", resp.Id, m.conn.RemoteAddr(), err)
+			continue
+		}
+		pq.ch <- resp
+	}
+}
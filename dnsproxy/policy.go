@@ -7,6 +7,8 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	logs "github.com/jursonmo/beelogs"
 	radixTrie "github.com/jursonmo/go-radix"
@@ -19,9 +21,13 @@ type Trier interface {
 	FindDomain(name string) (interface{}, error)
 }
 
+// PolicyConfig lists the dnsmasq style files the policy is loaded from:
+// files, and every file in path. The policy is reloaded on SIGHUP, and
+// when the files change if watch is set.
 type PolicyConfig struct {
 	Path  string   `toml:"path"`
 	Files []string `toml:"files"`
+	Watch bool     `toml:"watch"`
 }
 
 type policyValue struct {
@@ -35,18 +41,88 @@ type policyValue struct {
 type Policy struct {
 	path  string
 	files []string
-	tree  Trier
+	watch bool
+
+	// tree holds the Trier in use, it is swapped as a whole on reload
+	tree atomic.Value
+	// servers holds the server= addresses of tree, swapped along with it
+	servers  atomic.Value
+	reloadMu sync.Mutex
+	onReload func()
+
+	// serverOf maps the domains of the tree being loaded to their server=
+	serverOf map[string]string
 }
 
 func NewPolicy(cfg *PolicyConfig) *Policy {
-	return &Policy{
-		path:  cfg.Path,
-		files: cfg.Files,
-		tree:  radixTrie.New(),
+	p := &Policy{
+		path:     cfg.Path,
+		files:    cfg.Files,
+		watch:    cfg.Watch,
+		serverOf: make(map[string]string),
 	}
+	p.tree.Store(newTrier())
+	p.servers.Store([]string(nil))
+	return p
+}
+
+func newTrier() Trier {
+	return radixTrie.New()
+}
+
+func (p *Policy) getTree() Trier {
+	return p.tree.Load().(Trier)
 }
 
+// Load loads the policy files at startup. There is no policy to keep yet,
+// the valid lines are used when a file has invalid ones, and the error is
+// logged, a Reload of the same files fails until they are fixed.
 func (p *Policy) Load() {
+	tree, servers, err := p.build()
+	if err != nil {
+		logs.Error("load policy, invalid lines ignored: %v", err)
+	}
+	p.tree.Store(tree)
+	p.servers.Store(servers)
+}
+
+// OnReload sets the function called after each successful Reload.
+func (p *Policy) OnReload(fn func()) {
+	p.reloadMu.Lock()
+	p.onReload = fn
+	p.reloadMu.Unlock()
+}
+
+// Servers returns the server= addresses of the policy in use.
+func (p *Policy) Servers() []string {
+	return p.servers.Load().([]string)
+}
+
+// Reload loads the policy files again into a new tree and swaps it in,
+// queries keep using the current tree meanwhile. The current tree is kept
+// if a file can not be read or has invalid lines.
+func (p *Policy) Reload() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	tree, servers, err := p.build()
+	if err != nil {
+		logs.Error("reload policy fail, keep the current one: %v", err)
+		return err
+	}
+
+	p.tree.Store(tree)
+	p.servers.Store(servers)
+	logs.Info("policy reloaded")
+	if p.onReload != nil {
+		p.onReload()
+	}
+	return nil
+}
+
+// policyFiles returns the configured files and the files in path.
+func (p *Policy) policyFiles() []string {
+	files := append([]string(nil), p.files...)
 	dir, err := ioutil.ReadDir(p.path)
 	if err == nil {
 		for _, file := range dir {
@@ -54,22 +130,46 @@ func (p *Policy) Load() {
 				continue
 			}
 
-			p.files = append(p.files, fmt.Sprintf("%s/%s", p.path, file.Name()))
+			files = append(files, fmt.Sprintf("%s/%s", p.path, file.Name()))
 		}
 	}
+	return files
+}
 
-	for _, file := range p.files {
-		p.loadfile(file)
+// build loads every policy file into a new tree, and returns it with its
+// server= addresses and the first error met.
+func (p *Policy) build() (Trier, []string, error) {
+	np := &Policy{serverOf: make(map[string]string)}
+	np.tree.Store(newTrier())
+
+	var first error
+	for _, file := range p.policyFiles() {
+		// a missing file has no rules, it may be created later
+		if err := np.loadfile(file); err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+	seen := make(map[string]bool)
+	var servers []string
+	for _, srv := range np.serverOf {
+		if !seen[srv] {
+			seen[srv] = true
+			servers = append(servers, srv)
+		}
 	}
+	return np.getTree(), servers, first
 }
 
-func (p *Policy) loadfile(file string) {
+func (p *Policy) loadfile(file string) error {
 	fp, err := os.Open(file)
 	if err != nil {
 		logs.Warn("open file:%s, fail: %v", file, err)
-		return
+		return err
 	}
+	defer fp.Close()
+
 	logs.Info("load config :%s", file)
+	var first error
 	br := bufio.NewReader(fp)
 	for {
 		bline, _, err := br.ReadLine()
@@ -77,48 +177,76 @@ func (p *Policy) loadfile(file string) {
 			break
 		}
 
-		p.loadline(string(bline))
+		if err := p.loadline(string(bline)); err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", file, err)
+		}
 	}
+	return first
 }
 
-func (p *Policy) loadline(line string) {
-	line = strings.TrimLeft(line, " ")
+func (p *Policy) loadline(line string) error {
+	line = strings.Trim(line, " \t\r")
 
-	if strings.HasPrefix(line, "#") {
-		return
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
 	}
 
 	// server=/whatsapp.com/8.8.8.8#53
 	// ipset=/whatsapp.com/US-DNS,US-DNSv6
 	// script=/whatsapp.com//data/dnsproxy/route.sh
 	// address=/whatsapp.com/192.168.4.157
+	plugin := line
+	if i := strings.Index(line, "="); i >= 0 {
+		plugin = line[:i+1]
+	}
+	switch plugin {
+	case "server=", "ipset=", "script=", "address=":
+	default:
+		// other dnsmasq options
+		logs.Debug("ignore line:%s", line)
+		return nil
+	}
+
+	// server=8.8.8.8 sets an upstream for every domain, the upstreams
+	// come from dns.upper here
+	if plugin == "server=" && !strings.Contains(line, "/") {
+		logs.Debug("ignore line:%s", line)
+		return nil
+	}
+
 	sp := strings.Split(line, "/")
-	if len(sp) < 3 {
+	if len(sp) < 3 || sp[0] != plugin {
 		logs.Warn("invalid line:%s", line)
-		return
+		return fmt.Errorf("invalid line: %s", line)
 	}
 
-	plugin := sp[0]
 	domain := fmt.Sprintf("*.%s", sp[1]) //add wildcard, baidu.com-->*.baidu.com, www.baidu.com will match this, but wwwbaidu.com not match
 
 	// plugin为script时，策略可能包含路径的/
 	policy := strings.Join(sp[2:], "/")
 
 	logs.Debug("plugin:%s, domain:%s, policy:%s\n", plugin, domain, policy)
+	tree := p.getTree()
 	switch plugin {
 	case "server=":
-		ele, err := p.tree.FindDomain(domain)
+		ele, err := tree.FindDomain(domain)
 		if err != nil {
 			ele = &policyValue{}
 		}
 
-		ele.(*policyValue).server = strings.Replace(policy, "#", ":", -1)
+		// 8.8.8.8#53 --> 8.8.8.8:53, tls://1.1.1.1:853#cloudflare-dns.com 保持不变
+		if strings.Contains(policy, "://") {
+			ele.(*policyValue).server = policy
+		} else {
+			ele.(*policyValue).server = strings.Replace(policy, "#", ":", -1)
+		}
 		ele.(*policyValue).domain = domain
+		p.serverOf[domain] = ele.(*policyValue).server
 
-		p.tree.InsertDomain(domain, ele)
+		tree.InsertDomain(domain, ele)
 
 	case "ipset=":
-		ele, err := p.tree.FindDomain(domain)
+		ele, err := tree.FindDomain(domain)
 		if err != nil {
 			ele = &policyValue{}
 		}
@@ -126,10 +254,10 @@ func (p *Policy) loadline(line string) {
 		ele.(*policyValue).ipset = strings.Split(policy, ",")
 		ele.(*policyValue).domain = domain
 
-		p.tree.InsertDomain(domain, ele)
+		tree.InsertDomain(domain, ele)
 
 	case "script=":
-		ele, err := p.tree.FindDomain(domain)
+		ele, err := tree.FindDomain(domain)
 		if err != nil {
 			ele = &policyValue{}
 		}
@@ -137,7 +265,7 @@ func (p *Policy) loadline(line string) {
 		ele.(*policyValue).script = policy
 		ele.(*policyValue).domain = domain
 
-		p.tree.InsertDomain(domain, ele)
+		tree.InsertDomain(domain, ele)
 
 	case "address=":
 		// ele, err := p.tree.Find(domain)
@@ -149,8 +277,10 @@ func (p *Policy) loadline(line string) {
 		// ele.(*policyValue).domain = domain
 
 		ele := &policyValue{address: policy, domain: domain}
-		p.tree.InsertDomain(domain, ele)
+		tree.InsertDomain(domain, ele)
+		delete(p.serverOf, domain)
 	}
+	return nil
 }
 
 func (p *Policy) Exec(domain string, resp *dns.Msg) {
@@ -241,5 +371,5 @@ func (p *Policy) GetAddress(domain string) []string {
 }
 
 func (p *Policy) FindDomain(domain string) (interface{}, error) {	
-	return p.tree.FindDomain("."+domain)
+	return p.getTree().FindDomain("."+domain)
 }
\ No newline at end of file
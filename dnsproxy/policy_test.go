@@ -1,6 +1,12 @@
 package dnsproxy
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 type LoadCase struct {
 	in     string
@@ -161,3 +167,125 @@ func TestLoadAddressNotMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadServerTLS(t *testing.T) {
+	p.loadline("server=/tls.tech/tls://1.1.1.1:853#cloudflare-dns.com")
+	upper := p.GetUpper("www.tls.tech")
+	if len(upper) <= 0 {
+		t.Fatal("expect upper not nil, got nil")
+	}
+
+	if upper[0] != "tls://1.1.1.1:853#cloudflare-dns.com" {
+		t.Fatalf("expect upper tls://1.1.1.1:853#cloudflare-dns.com, got %s\n", upper[0])
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.conf")
+	ioutil.WriteFile(file, []byte("server=/reload.tech/1.1.1.1#53\n\nconf-dir=/etc/dnsmasq.d\n"), 0644)
+
+	pl := NewPolicy(&PolicyConfig{Path: dir, Files: []string{filepath.Join(dir, "missing.conf")}})
+	pl.Load()
+	if upper := pl.GetUpper("reload.tech"); len(upper) != 1 || upper[0] != "1.1.1.1:53" {
+		t.Fatalf("expect upper 1.1.1.1:53, got %v", upper)
+	}
+
+	ioutil.WriteFile(file, []byte("server=/reload.tech/2.2.2.2#53\n"), 0644)
+	if err := pl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if upper := pl.GetUpper("reload.tech"); len(upper) != 1 || upper[0] != "2.2.2.2:53" {
+		t.Errorf("expect upper 2.2.2.2:53 after reload, got %v", upper)
+	}
+	if servers := pl.Servers(); len(servers) != 1 || servers[0] != "2.2.2.2:53" {
+		t.Errorf("expect only server 2.2.2.2:53 in use, got %v", servers)
+	}
+
+	ioutil.WriteFile(file, []byte("server=/other.tech/3.3.3.3#53\nipset=broken\n"), 0644)
+	if err := pl.Reload(); err == nil {
+		t.Error("expect reload error for invalid line")
+	}
+	if upper := pl.GetUpper("reload.tech"); len(upper) != 1 || upper[0] != "2.2.2.2:53" {
+		t.Errorf("expect old policy kept, got %v", upper)
+	}
+	if upper := pl.GetUpper("other.tech"); len(upper) != 0 {
+		t.Errorf("expect invalid file not applied, got %v", upper)
+	}
+
+	// a server= without domain is a dnsmasq option the proxy ignores
+	ioutil.WriteFile(file, []byte("server=8.8.8.8\nserver=/other.tech/3.3.3.3#53\n"), 0644)
+	if err := pl.Reload(); err != nil {
+		t.Errorf("expect server= without domain ignored, got %v", err)
+	}
+	if upper := pl.GetUpper("other.tech"); len(upper) != 1 || upper[0] != "3.3.3.3:53" {
+		t.Errorf("expect other.tech on 3.3.3.3:53, got %v", upper)
+	}
+	if servers := pl.Servers(); len(servers) != 1 {
+		t.Errorf("expect only server 3.3.3.3:53 in use, got %v", servers)
+	}
+}
+
+func TestPolicyWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.conf")
+	ioutil.WriteFile(file, []byte("server=/watch.tech/1.1.1.1#53\n"), 0644)
+
+	defer func(d time.Duration) { policyWatchDelay = d }(policyWatchDelay)
+	policyWatchDelay = 50 * time.Millisecond
+	pl := NewPolicy(&PolicyConfig{Files: []string{file}, Watch: true})
+	pl.Load()
+
+	done := make(chan struct{})
+	defer close(done)
+	go pl.Watch(done)
+	time.Sleep(100 * time.Millisecond)
+
+	// replaced by rename, as editors do
+	tmp := filepath.Join(dir, "policy.conf.tmp")
+	ioutil.WriteFile(tmp, []byte("server=/watch.tech/2.2.2.2#53\n"), 0644)
+	os.Rename(tmp, file)
+
+	for i := 0; i < 50; i++ {
+		if upper := pl.GetUpper("watch.tech"); len(upper) == 1 && upper[0] == "2.2.2.2:53" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("expect policy reloaded on change, got %v", pl.GetUpper("watch.tech"))
+}
+
+func TestPolicyPollFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(d time.Duration) { policyPollInterval = d }(policyPollInterval)
+	policyPollInterval = 20 * time.Millisecond
+
+	pl := NewPolicy(&PolicyConfig{Path: dir})
+	changes := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go pl.pollFiles(changes, done)
+	time.Sleep(50 * time.Millisecond)
+
+	ioutil.WriteFile(filepath.Join(dir, "new.conf"), []byte("server=/poll.tech/1.1.1.1#53\n"), 0644)
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Error("expect new file noticed")
+	}
+}
@@ -0,0 +1,116 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+)
+
+var (
+	// policyWatchDelay coalesces the bursts of changes of a file being
+	// written into one reload
+	policyWatchDelay = 500 * time.Millisecond
+
+	// policyPollInterval is how often the files are looked at when they
+	// can not be watched
+	policyPollInterval = 5 * time.Second
+)
+
+// Watch reloads the policy when its files change, until done is closed.
+// It does nothing unless watch is set.
+func (p *Policy) Watch(done <-chan struct{}) {
+	if !p.watch {
+		return
+	}
+
+	wait := policyWatchDelay
+	changes := make(chan struct{}, 1)
+	go p.watchFiles(changes, done)
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-changes:
+			delay = time.After(wait)
+
+		case <-delay:
+			delay = nil
+			p.Reload()
+		}
+	}
+}
+
+// watchDirs returns the directories holding the policy files, with the
+// names of the files watched in each; nil names for path, where every
+// file is.
+func (p *Policy) watchDirs() map[string]map[string]bool {
+	dirs := make(map[string]map[string]bool)
+	if p.path != "" {
+		dirs[filepath.Clean(p.path)] = nil
+	}
+
+	for _, file := range p.files {
+		dir := filepath.Dir(file)
+		names, ok := dirs[dir]
+		if ok && names == nil {
+			continue
+		}
+		if names == nil {
+			names = make(map[string]bool)
+			dirs[dir] = names
+		}
+		names[filepath.Base(file)] = true
+	}
+	return dirs
+}
+
+// pollFiles reports a change when a policy file is added, removed, or its
+// size or modification time changes.
+func (p *Policy) pollFiles(changes chan<- struct{}, done <-chan struct{}) {
+	interval := policyPollInterval
+	last := p.filesState()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		state := p.filesState()
+		if state != last {
+			last = state
+			notifyChange(changes)
+		}
+	}
+}
+
+func (p *Policy) filesState() string {
+	var sb strings.Builder
+	for _, file := range p.policyFiles() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&sb, "%s -\n", file)
+			continue
+		}
+		fmt.Fprintf(&sb, "%s %d %d\n", file, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sb.String()
+}
+
+func notifyChange(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+func logWatchFallback(err error) {
+	logs.Warn("watch policy files fail: %v, poll them every %v", err, policyPollInterval)
+}
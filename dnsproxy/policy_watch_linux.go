@@ -0,0 +1,84 @@
+package dnsproxy
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	logs "github.com/jursonmo/beelogs"
+)
+
+const policyWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+
+// watchFiles reports the changes of the policy files seen by inotify. The
+// directories are watched rather than the files, editors often replace a
+// file by renaming a new one over it.
+func (p *Policy) watchFiles(changes chan<- struct{}, done <-chan struct{}) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		logWatchFallback(err)
+		p.pollFiles(changes, done)
+		return
+	}
+
+	// a non-blocking fd is read through the runtime poller, closing it
+	// ends the read below
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-done
+		f.Close()
+	}()
+
+	dirs := p.watchDirs()
+	wds := make(map[int32]map[string]bool)
+	for dir, names := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, policyWatchMask)
+		if err != nil {
+			logs.Warn("watch policy dir %s fail: %v", dir, err)
+			continue
+		}
+		wds[int32(wd)] = names
+	}
+
+	if len(wds) == 0 && len(dirs) > 0 {
+		f.Close()
+		logWatchFallback(syscall.ENOENT)
+		p.pollFiles(changes, done)
+		return
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			select {
+			case <-done:
+			default:
+				logs.Warn("read policy watch events fail: %v", err)
+			}
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			end := start + int(ev.Len)
+			if end > n {
+				break
+			}
+			off = end
+
+			name := string(buf[start:end])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+
+			names, ok := wds[ev.Wd]
+			if ok && (names == nil || names[name]) {
+				logs.Debug("policy file %s changed", name)
+				notifyChange(changes)
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package dnsproxy
+
+func (p *Policy) watchFiles(changes chan<- struct{}, done <-chan struct{}) {
+	p.pollFiles(changes, done)
+}
@@ -1,9 +1,13 @@
 package dnsproxy
 
 import (
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	logs "github.com/jursonmo/beelogs"
@@ -15,28 +19,106 @@ var (
 	defaultTimeout     = 3
 	defaultConcurrency = 10
 	defaultQueueSize   = defaultConcurrency * 5
+	defaultIdleTimeout = 10
+	defaultDoHMethod   = http.MethodPost
+	defaultStrategy    = strategySequential
+	defaultPoolSize    = 4
+	defaultPoolRotate  = 1000
+	defaultTLSAddr     = ":853"
+	defaultHTTPSAddr   = ":443"
+	defaultDoHPath     = "/dns-query"
 )
 
 type ProxyConfig struct {
 	Upper       []string `toml:"upper"`
+	Strategy    string   `toml:"strategy"`
+	UpperCAFile string   `toml:"upper_ca_file"`
+	DoHMethod   string   `toml:"doh_method"`
+	PoolSize    int      `toml:"pool_size"`
+	PoolRotate  int      `toml:"pool_rotate"`
 	ListenAddr  string   `toml:"listen_addr"`
 	Timeout     int      `toml:"timeout"`
 	Concurrency int      `toml:"concurrency"`
 	QueueSize   int      `toml:"queue_size"`
+	IdleTimeout int      `toml:"idle_timeout"`
+
+	Health *HealthConfig      `toml:"health"`
+	TLS    *TLSServerConfig   `toml:"tls"`
+	HTTPS  *HTTPSServerConfig `toml:"https"`
+}
+
+// TLSServerConfig enables serving DNS-over-TLS to clients.
+type TLSServerConfig struct {
+	ListenAddr string `toml:"listen_addr"`
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+}
+
+// responseWriter sends a packed response back to the client the query
+// came from, whatever transport it arrived on.
+type responseWriter interface {
+	WriteMsg(msg []byte) error
 }
 
 type clientContext struct {
-	conn  *net.UDPConn
-	raddr *net.UDPAddr
-	buf   []byte
+	w   responseWriter
+	buf []byte
+	udp bool
+
+	// req and size are filled once buf is unpacked, size is the largest
+	// response the client accepts.
+	req  *dns.Msg
+	size int
+
+	// finish, when set, is called once the query is handled or dropped
+	finish func()
+}
+
+func (ctx *clientContext) done() {
+	if ctx.finish != nil {
+		ctx.finish()
+	}
+}
+
+type udpWriter struct {
+	conn    *net.UDPConn
+	raddr   *net.UDPAddr
+	timeout time.Duration
+}
+
+func (w *udpWriter) WriteMsg(msg []byte) error {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	_, err := w.conn.WriteToUDP(msg, w.raddr)
+	w.conn.SetWriteDeadline(time.Time{})
+	return err
 }
 
 type Proxy struct {
 	listenAddr  string
-	upper       []string
+	upper       []*trackedUpstream
+	strategy    string
+	rrIndex     uint32
 	concurrency int
 	qsize       int
 	timeout     time.Duration
+	idleTimeout time.Duration
+
+	tlsConfig *tls.Config
+	dohMethod string
+	poolSize  int
+	rotate    int
+	health    *healthOptions
+	upsMu     sync.Mutex
+	upstreams map[string]*trackedUpstream
+
+	tlsListenAddr string
+	tlsCert       *certReloader
+
+	httpsServer *http.Server
+
+	refreshMu  sync.Mutex
+	refreshing map[string]bool
+	flights    flightGroup
 
 	done   chan struct{}
 	cache  *Cache
@@ -70,17 +152,113 @@ func NewProxy(cfg *ProxyConfig, cache *Cache, policy *Policy) *Proxy {
 		qsize = defaultQueueSize
 	}
 
-	return &Proxy{
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	var err error
+	tlsConfig := &tls.Config{}
+	if cfg.UpperCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.UpperCAFile)
+		if err != nil {
+			logs.Error("read dns.upper_ca_file fail: %v", err)
+			return nil
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			logs.Error("no certificate found in dns.upper_ca_file %s", cfg.UpperCAFile)
+			return nil
+		}
+	}
+
+	dohMethod := strings.ToUpper(cfg.DoHMethod)
+	if dohMethod == "" {
+		dohMethod = defaultDoHMethod
+	}
+	if dohMethod != http.MethodGet && dohMethod != http.MethodPost {
+		logs.Error("dns.doh_method must be get or post, got %s", cfg.DoHMethod)
+		return nil
+	}
+
+	poolSize := cfg.PoolSize
+	if poolSize <= 0 {
+		poolSize = defaultPoolSize
+	}
+
+	rotate := cfg.PoolRotate
+	if rotate <= 0 {
+		rotate = defaultPoolRotate
+	}
+
+	strategy := strings.ToLower(cfg.Strategy)
+	if strategy == "" {
+		strategy = defaultStrategy
+	}
+	if !validStrategy(strategy) {
+		logs.Error("unknown dns.strategy %s", cfg.Strategy)
+		return nil
+	}
+
+	p := &Proxy{
 		listenAddr:  listenAddr,
-		upper:       cfg.Upper,
+		strategy:    strategy,
 		concurrency: concurrency,
 		qsize:       qsize,
 		timeout:     time.Duration(timeout) * time.Second,
+		idleTimeout: time.Duration(idleTimeout) * time.Second,
 		done:        make(chan struct{}),
 		cache:       cache,
 		policy:      policy,
 		queue:       make(chan *clientContext, qsize),
+		tlsConfig:   tlsConfig,
+		dohMethod:   dohMethod,
+		poolSize:    poolSize,
+		rotate:      rotate,
+		upstreams:   make(map[string]*trackedUpstream),
+		health:      newHealthOptions(cfg.Health),
+		refreshing:  make(map[string]bool),
+	}
+
+	if cfg.TLS != nil {
+		p.tlsListenAddr = cfg.TLS.ListenAddr
+		if p.tlsListenAddr == "" {
+			p.tlsListenAddr = defaultTLSAddr
+		}
+
+		p.tlsCert, err = newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			logs.Error("load dns.tls certificate fail: %v", err)
+			return nil
+		}
+	}
+
+	if cfg.HTTPS != nil {
+		p.httpsServer, err = p.newHTTPSServer(cfg.HTTPS)
+		if err != nil {
+			logs.Error("load dns.https certificate fail: %v", err)
+			return nil
+		}
 	}
+
+	for _, addr := range cfg.Upper {
+		up, err := p.getUpstream(addr)
+		if err != nil {
+			logs.Error("invalid dns.upper %s: %v", addr, err)
+			return nil
+		}
+		p.upper = append(p.upper, up)
+	}
+
+	if cache != nil {
+		cache.SetRefresher(p.prefetch)
+	}
+	if policy != nil {
+		policy.OnReload(p.pruneUpstreams)
+	}
+
+	return p
 }
 
 func (p *Proxy) Run() error {
@@ -95,36 +273,94 @@ func (p *Proxy) Run() error {
 	}
 	defer conn.Close()
 
+	ln, err := net.Listen("tcp", p.listenAddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
 	for i := 0; i < p.concurrency; i++ {
 		go p.handleQuery()
 	}
 
+	if p.health.domain != "" {
+		go p.probe()
+	}
+
 	logs.Info("dns running on %s", p.listenAddr)
 
-	for {
-		select {
-		case <-p.done:
-			return nil
-		default:
+	errc := make(chan error, 4)
+	go func() { errc <- p.serveUDP(conn) }()
+	go func() { errc <- p.serveTCP(ln) }()
+
+	if p.tlsCert != nil {
+		tln, err := net.Listen("tcp", p.tlsListenAddr)
+		if err != nil {
+			return err
 		}
+		tln = tls.NewListener(tln, &tls.Config{GetCertificate: p.tlsCert.GetCertificate})
+		defer tln.Close()
+
+		logs.Info("dns over tls running on %s", p.tlsListenAddr)
+		go func() { errc <- p.serveTCP(tln) }()
+	}
 
-		buf := make([]byte, 512)
-		nr, raddr, err := conn.ReadFromUDP(buf)
+	if p.httpsServer != nil {
+		hln, err := net.Listen("tcp", p.httpsServer.Addr)
 		if err != nil {
 			return err
 		}
-		p.onQuery(conn, raddr, buf[:nr])
+		defer p.httpsServer.Close()
+
+		logs.Info("dns over https running on %s", p.httpsServer.Addr)
+		go func() {
+			if p.httpsServer.TLSConfig != nil {
+				errc <- p.httpsServer.ServeTLS(hln, "", "")
+			} else {
+				errc <- p.httpsServer.Serve(hln)
+			}
+		}()
 	}
 
+	select {
+	case <-p.done:
+		return nil
+	case err = <-errc:
+		return err
+	}
 }
 
 func (p *Proxy) Stop() {
 	close(p.done)
 }
 
-func (p *Proxy) onQuery(conn *net.UDPConn, raddr *net.UDPAddr, buf []byte) {
-	// go p.handleQuery(conn, raddr, buf)
-	p.queue <- &clientContext{conn, raddr, buf}
+func (p *Proxy) serveUDP(conn *net.UDPConn) error {
+	rbuf := make([]byte, dns.MaxMsgSize)
+	for {
+		select {
+		case <-p.done:
+			return nil
+		default:
+		}
+
+		nr, raddr, err := conn.ReadFromUDP(rbuf)
+		if err != nil {
+			return err
+		}
+
+		buf := make([]byte, nr)
+		copy(buf, rbuf)
+		w := &udpWriter{conn: conn, raddr: raddr, timeout: p.timeout}
+		p.onQuery(&clientContext{w: w, buf: buf, udp: true})
+	}
+}
+
+func (p *Proxy) onQuery(ctx *clientContext) {
+	select {
+	case p.queue <- ctx:
+	case <-p.done:
+		ctx.done()
+	}
 }
 
 func (p *Proxy) handleQuery() {
@@ -135,135 +371,101 @@ func (p *Proxy) handleQuery() {
 			return
 
 		case ctx := <-p.queue:
-			conn, raddr, buf := ctx.conn, ctx.raddr, ctx.buf
-
-			req := &dns.Msg{}
-			err := req.Unpack(buf)
-			if err != nil {
-				logs.Warn("invalid dns request: %v", err)
-				continue
-			}
+			p.serveQuery(ctx)
+			ctx.done()
+		}
+	}
+}
 
-			if len(req.Question) <= 0 {
-				logs.Warn("empty question")
-				continue
-			}
+func (p *Proxy) serveQuery(ctx *clientContext) {
+	req := &dns.Msg{}
+	err := req.Unpack(ctx.buf)
+	if err != nil {
+		logs.Warn("invalid dns request: %v", err)
+		return
+	}
 
-			domain := strings.ToLower(req.Question[0].Name)
-			//请求域名后面有加"."
-			//fmt.Printf("debug, domain:%s\n", domain)// "baidu.com."
-			//clear last char if is '.'
-			if domain[len(domain)-1] == '.' {
-				domain = domain[:len(domain)-1]
-			}
-			address := p.policy.GetAddress(domain)
-			if len(address) > 0 {
-				logs.Debug("GetAddress ok, domain:%s, address:%v", domain, address)
-				err = p.handleAddress(domain, conn, raddr, req, address)
-				if err == nil {
-					logs.Debug("%s => %s", domain, "buildin")
-					continue
-				}
-			}
+	if len(req.Question) <= 0 {
+		logs.Warn("empty question")
+		return
+	}
 
-			if p.cache != nil {
-				// 缓存查询仅针对A记录和AAAA记录
-				support := true
-				for _, as := range req.Question {
-					if as.Qtype != dns.TypeA && as.Qtype != dns.TypeAAAA {
-						support = false
-					}
-				}
-
-				if support {
-					ele := p.cache.Get(domain)
-					if ele != nil {
-						err = p.handleCache(domain, conn, raddr, req, ele.(*dns.Msg))
-						if err == nil {
-							logs.Debug("%s => %s", domain, "cache")
-							continue
-						}
-					}
-				}
-			}
+	ctx.req = req
+	ctx.size = dns.MaxMsgSize
+	if ctx.udp {
+		ctx.size = udpSize(req)
+	}
 
-			upper := p.upper
-			if p.policy != nil {
-				pupper := p.policy.GetUpper(domain)
-				if len(pupper) > 0 {
-					logs.Debug("GetUpper ok, domain:%s, upper:%v", domain, pupper)
-					upper = pupper
-				}
+	domain := strings.ToLower(req.Question[0].Name)
+	//请求域名后面有加"."
+	//fmt.Printf("debug, domain:%s\n", domain)// "baidu.com."
+	//clear last char if is '.'
+	if domain[len(domain)-1] == '.' {
+		domain = domain[:len(domain)-1]
+	}
+	if p.policy != nil {
+		address := p.policy.GetAddress(domain)
+		if len(address) > 0 {
+			logs.Debug("GetAddress ok, domain:%s, address:%v", domain, address)
+			err = p.handleAddress(domain, ctx, address)
+			if err == nil {
+				logs.Debug("%s => %s", domain, "buildin")
+				return
 			}
+		}
+	}
 
-			for _, up := range upper {
-				resp, err := p.resolve(up, buf)
-				if err != nil {
-					logs.Warn("resolve from upper: %s fail: %v", up, err)
-					continue
-				}
-
-				err = p.handleResult(domain, conn, raddr, resp)
-				if err != nil {
-					logs.Warn("response result fail: %v", err)
-					continue
-				}
-
-				logs.Debug("%s => %s", domain, up)
-				if p.cache != nil {
-					// 缓存存储仅针对A记录和AAAA记录
-					needcache := true
-					for _, as := range resp.Answer {
-						hdr := as.Header()
-						if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
-							needcache = false
-							break
-						}
-					}
-
-					if needcache {
-						p.cache.Set(domain, resp)
-					}
-				}
-
-				break
+	if p.cache != nil {
+		ele := p.cache.Get(cacheKey(req))
+		if ele != nil {
+			err = p.handleCache(domain, ctx, ele)
+			if err == nil {
+				logs.Debug("%s => %s", domain, "cache")
+				return
 			}
 		}
 	}
-}
 
-func (p *Proxy) resolve(upper string, buf []byte) (*dns.Msg, error) {
-	conn, err := net.DialTimeout("udp", upper, p.timeout)
+	upper := p.upstreamsFor(domain)
+	resp, up, leader, err := p.resolve(upper, req)
 	if err != nil {
-		return nil, err
+		logs.Warn("resolve %s fail: %v", domain, err)
+		p.serveStale(domain, ctx, upper)
+		return
 	}
-	defer conn.Close()
 
-	conn.SetWriteDeadline(time.Now().Add(p.timeout))
-	_, err = conn.Write(buf)
-	conn.SetWriteDeadline(time.Time{})
-	if err != nil {
-		return nil, err
+	// every upstream answered SERVFAIL or REFUSED, a stale answer is better
+	if !validAnswer(resp) && p.serveStale(domain, ctx, upper) {
+		return
 	}
 
-	res := make([]byte, 512)
-	conn.SetReadDeadline(time.Now().Add(p.timeout))
-	nr, err := conn.Read(res)
-	conn.SetWriteDeadline(time.Time{})
+	err = p.handleResult(domain, ctx, resp)
 	if err != nil {
-		return nil, err
+		logs.Warn("response result fail: %v", err)
+		return
 	}
 
-	rmsg := &dns.Msg{}
-	err = rmsg.Unpack(res[:nr])
-	if err != nil {
-		return nil, err
+	logs.Debug("%s => %s", domain, up)
+	if leader && p.cache != nil && cacheable(resp) {
+		p.cache.Set(cacheKey(req), resp)
 	}
+}
 
-	return rmsg, nil
+// upstreamsFor returns the server= upstreams of domain, or the global
+// upper list.
+func (p *Proxy) upstreamsFor(domain string) []*trackedUpstream {
+	if p.policy != nil {
+		pupper := p.policy.GetUpper(domain)
+		if len(pupper) > 0 {
+			logs.Debug("GetUpper ok, domain:%s, upper:%v", domain, pupper)
+			return p.policyUpstreams(pupper)
+		}
+	}
+	return p.upper
 }
 
-func (p *Proxy) handleAddress(domain string, conn *net.UDPConn, raddr *net.UDPAddr, req *dns.Msg, address []string) error {
+func (p *Proxy) handleAddress(domain string, ctx *clientContext, address []string) error {
+	req := ctx.req
 	resp := req.Copy()
 	resp.Response = true
 
@@ -285,45 +487,39 @@ func (p *Proxy) handleAddress(domain string, conn *net.UDPConn, raddr *net.UDPAd
 		}
 	}
 
-	return p.handleResult(domain, conn, raddr, resp)
+	return p.handleResult(domain, ctx, resp)
 }
 
-func (p *Proxy) handleCache(domain string, conn *net.UDPConn, raddr *net.UDPAddr, req, cv *dns.Msg) error {
-	resp := req.Copy()
-	resp.Response = true
-
-	for _, qs := range req.Question {
-		for _, as := range cv.Answer {
-			hdr := *as.Header()
-
-			if qs.Qtype == hdr.Rrtype {
-				switch hdr.Rrtype {
-				case dns.TypeA:
-					if an, ok := as.(*dns.A); ok && an != nil {
-						resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: an.A})
-					}
-
-				case dns.TypeAAAA:
-					if an, ok := as.(*dns.AAAA); ok && an != nil {
-						resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: an.AAAA})
-					}
-
-				default:
-					return fmt.Errorf("unsupported")
+// handleCache replays a cached answer, whole sections included, as the
+// response to the client's own query.
+func (p *Proxy) handleCache(domain string, ctx *clientContext, cv *dns.Msg) error {
+	replyTo(cv, ctx.req)
+	return p.handleResult(domain, ctx, cv)
+}
 
-				}
-			}
+// replyTo turns resp, the answer to the same question asked by another
+// query, into the answer to req: its id, flags and question, and an OPT
+// record built for req alone.
+func replyTo(resp, req *dns.Msg) {
+	resp.Id = req.Id
+	resp.RecursionDesired = req.RecursionDesired
+	resp.CheckingDisabled = req.CheckingDisabled
+	resp.Question = append([]dns.Question(nil), req.Question...)
+
+	extra := make([]dns.RR, 0, len(resp.Extra))
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
 		}
 	}
+	resp.Extra = extra
 
-	if len(resp.Answer) <= 0 {
-		return fmt.Errorf("empty answer")
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, opt.Do())
 	}
-
-	return p.handleResult(domain, conn, raddr, resp)
 }
 
-func (p *Proxy) handleResult(domain string, conn *net.UDPConn, raddr *net.UDPAddr, res *dns.Msg) error {
+func (p *Proxy) handleResult(domain string, ctx *clientContext, res *dns.Msg) error {
 	if p.policy != nil {
 		p.policy.Exec(domain, res)
 	}
@@ -333,12 +529,28 @@ func (p *Proxy) handleResult(domain string, conn *net.UDPConn, raddr *net.UDPAdd
 		return err
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(p.timeout))
-	_, err = conn.WriteToUDP(msg, raddr)
-	conn.SetWriteDeadline(time.Time{})
-	if err != nil {
-		return err
+	if len(msg) > ctx.size {
+		// res may be shared with the cache, truncate a copy. Truncate
+		// resets TC when everything fits, keep the one set by upper.
+		tc := res.Truncated
+		res = res.Copy()
+		res.Truncate(ctx.size)
+		res.Truncated = res.Truncated || tc
+		msg, err = res.Pack()
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return ctx.w.WriteMsg(msg)
+}
+
+// udpSize returns the udp payload size advertised by the OPT record of msg,
+// or the 512 bytes limit of plain dns.
+func udpSize(msg *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := msg.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
 }
@@ -0,0 +1,510 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUpper runs a fake upstream dns server on a local udp and tcp port
+// and returns its address and a function shutting it down.
+func startUpper(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	var pc net.PacketConn
+	var ln net.Listener
+	var err error
+	// the tcp port of the same number may be taken, try another one
+	for i := 0; i < 10; i++ {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ln, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpSrv := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpSrv := &dns.Server{Listener: ln, Handler: handler}
+	go udpSrv.ActivateAndServe()
+	go tcpSrv.ActivateAndServe()
+	stop := func() {
+		udpSrv.Shutdown()
+		tcpSrv.Shutdown()
+	}
+
+	return pc.LocalAddr().String(), stop
+}
+
+// answerA replies every question with one A record.
+func answerA(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for _, q := range req.Question {
+			rr, _ := dns.NewRR(q.Name + " 300 IN A " + ip)
+			resp.Answer = append(resp.Answer, rr)
+		}
+		w.WriteMsg(resp)
+	}
+}
+
+func startProxy(t *testing.T, cfg *ProxyConfig, cache *Cache, policy *Policy) *Proxy {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ListenAddr = pc.LocalAddr().String()
+	pc.Close()
+
+	p := NewProxy(cfg, cache, policy)
+	go p.Run()
+
+	if !listening(cfg.ListenAddr) {
+		p.Stop()
+		t.Fatalf("proxy not listening on %s", cfg.ListenAddr)
+	}
+	return p
+}
+
+// listening waits for a tcp listener on addr.
+func listening(addr string) bool {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTCPPipeline(t *testing.T) {
+	upper, stop := startUpper(t, answerA("1.2.3.4"))
+	defer stop()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}}, nil, nil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ids := map[uint16]string{}
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		ids[req.Id] = name
+
+		buf, _ := req.Pack()
+		if err := writeTCPMsg(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for range ids {
+		buf, err := readTCPMsg(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := &dns.Msg{}
+		if err := resp.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		name, ok := ids[resp.Id]
+		if !ok || len(resp.Answer) != 1 || resp.Answer[0].Header().Name != name {
+			t.Errorf("unexpected response %v", resp)
+		}
+		delete(ids, resp.Id)
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	upper, stop := startUpper(t, answerA("1.2.3.4"))
+	defer stop()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}, IdleTimeout: 1}, nil, nil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := readTCPMsg(conn); err == nil {
+		t.Error("expect idle connection closed by proxy")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("expect connection closed before read deadline, got %v", err)
+	}
+}
+
+func TestTCPPendingQuery(t *testing.T) {
+	slow := func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(1500 * time.Millisecond)
+		answerA("1.2.3.4")(w, req)
+	}
+	upper, stop := startUpper(t, slow)
+	defer stop()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}, IdleTimeout: 1}, nil, nil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	buf, _ := req.Pack()
+	if err := writeTCPMsg(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	// the answer outlives both the idle timeout and the client's half close
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf, err = readTCPMsg(conn)
+	if err != nil {
+		t.Fatalf("expect answer of pending query, got %v", err)
+	}
+
+	resp := &dns.Msg{}
+	if err := resp.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) != 1 {
+		t.Errorf("unexpected response %v", resp)
+	}
+}
+
+// answerManyA replies with n A records, enough to exceed 512 bytes.
+func answerManyA(n int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for i := 0; i < n; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+			})
+		}
+		if opt := req.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), false)
+		}
+		if w.LocalAddr().Network() == "udp" {
+			resp.Truncate(udpSize(req))
+		}
+		w.WriteMsg(resp)
+	}
+}
+
+func TestUDPSize(t *testing.T) {
+	upper, stop := startUpper(t, answerManyA(100))
+	defer stop()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}}, nil, nil)
+	defer p.Stop()
+
+	for _, c := range []struct {
+		edns      uint16
+		truncated bool
+	}{
+		{edns: 0, truncated: true},
+		{edns: 4096, truncated: false},
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion("many.example.com.", dns.TypeA)
+		if c.edns > 0 {
+			req.SetEdns0(c.edns, false)
+		}
+
+		client := &dns.Client{UDPSize: 65535}
+		resp, _, err := client.Exchange(req, p.listenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Truncated != c.truncated {
+			t.Errorf("edns %d: expect truncated %v, got %v", c.edns, c.truncated, resp.Truncated)
+		}
+
+		if !c.truncated && len(resp.Answer) != 100 {
+			t.Errorf("edns %d: expect 100 answers, got %d", c.edns, len(resp.Answer))
+		}
+	}
+}
+
+func TestTruncatedRetryTCP(t *testing.T) {
+	upper, stop := startUpper(t, answerManyA(100))
+	defer stop()
+	cache := NewCache(&CacheConfig{})
+	defer cache.Close()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}}, cache, nil)
+	defer p.Stop()
+
+	req := &dns.Msg{}
+	req.SetQuestion("many.example.com.", dns.TypeA)
+
+	client := &dns.Client{Net: "tcp"}
+	resp, _, err := client.Exchange(req, p.listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Truncated || len(resp.Answer) != 100 {
+		t.Errorf("expect complete answer, got truncated %v with %d answers", resp.Truncated, len(resp.Answer))
+	}
+
+	cv := cache.Get(cacheKey(req))
+	if cv == nil || len(cv.Answer) != 100 {
+		t.Errorf("expect complete answer cached, got %v", cv)
+	}
+}
+
+func freeTCPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certCheckInterval = 0
+	defer func() { certCheckInterval = 10 * time.Second }()
+
+	certFile, keyFile := writeTestCert(t, dir, "dns.test")
+	upper, stop := startUpper(t, answerA("1.2.3.4"))
+	defer stop()
+
+	tlsAddr := freeTCPAddr(t)
+	p := startProxy(t, &ProxyConfig{
+		Upper: []string{upper},
+		TLS:   &TLSServerConfig{ListenAddr: tlsAddr, CertFile: certFile, KeyFile: keyFile},
+	}, nil, nil)
+	defer p.Stop()
+	if !listening(tlsAddr) {
+		t.Fatalf("proxy not listening on %s", tlsAddr)
+	}
+
+	query := func(serverName string) error {
+		pem, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+
+		client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool, ServerName: serverName}}
+		req := &dns.Msg{}
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		resp, _, err := client.Exchange(req, tlsAddr)
+		if err != nil {
+			return err
+		}
+
+		if len(resp.Answer) != 1 {
+			return fmt.Errorf("unexpected response %v", resp)
+		}
+		return nil
+	}
+
+	if err := query("dns.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the certificate, the listener must serve the new one
+	os.Remove(certFile)
+	os.Remove(keyFile)
+	newCert, newKey := writeTestCert(t, dir, "dns.test")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(newCert, future, future)
+	os.Chtimes(newKey, future, future)
+
+	if err := query("dns.test"); err != nil {
+		t.Fatalf("expect reloaded certificate trusted, got %v", err)
+	}
+}
+
+func TestServeHTTPS(t *testing.T) {
+	upper, stop := startUpper(t, answerA("1.2.3.4"))
+	defer stop()
+
+	httpsAddr := freeTCPAddr(t)
+	p := startProxy(t, &ProxyConfig{
+		Upper: []string{upper},
+		HTTPS: &HTTPSServerConfig{ListenAddr: httpsAddr},
+	}, nil, nil)
+	defer p.Stop()
+	if !listening(httpsAddr) {
+		t.Fatalf("proxy not listening on %s", httpsAddr)
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.Id = 0
+	buf, _ := req.Pack()
+	url := "http://" + httpsAddr + "/dns-query"
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		var hresp *http.Response
+		var err error
+		if method == http.MethodGet {
+			hresp, err = http.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(buf))
+		} else {
+			hresp, err = http.Post(url, dohMediaType, bytes.NewReader(buf))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(hresp.Body)
+		hresp.Body.Close()
+		if hresp.StatusCode != http.StatusOK || hresp.Header.Get("Content-Type") != dohMediaType {
+			t.Fatalf("%s: unexpected http response %s %s", method, hresp.Status, body)
+		}
+
+		resp := &dns.Msg{}
+		if err := resp.Unpack(body); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%s: unexpected response %v", method, resp)
+		}
+	}
+
+	hresp, err := http.Get(url + "?name=a.example.com&type=A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hresp.Body.Close()
+
+	var jm jsonMsg
+	if err := json.NewDecoder(hresp.Body).Decode(&jm); err != nil {
+		t.Fatal(err)
+	}
+	if len(jm.Answer) != 1 || jm.Answer[0].Data != "1.2.3.4" || jm.Answer[0].Type != dns.TypeA {
+		t.Errorf("unexpected json response %+v", jm)
+	}
+
+	noQuestion, _ := (&dns.Msg{}).Pack()
+	for name, body := range map[string][]byte{"malformed": []byte("not a dns message"), "no question": noQuestion} {
+		start := time.Now()
+		hresp, err := http.Post(url, dohMediaType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hresp.Body.Close()
+		if hresp.StatusCode != http.StatusBadRequest || time.Since(start) > time.Second {
+			t.Errorf("%s: expect immediate 400, got %s after %v", name, hresp.Status, time.Since(start))
+		}
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	upper, stop := startUpper(t, answerA("1.2.3.4"))
+	cache := NewCache(&CacheConfig{Enable: true, StaleTTL: 3600})
+	defer cache.Close()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}, Timeout: 1}, cache, nil)
+	defer p.Stop()
+
+	req := &dns.Msg{}
+	req.SetQuestion("stale.example.com.", dns.TypeA)
+	client := &dns.Client{Timeout: 5 * time.Second}
+	if _, _, err := client.Exchange(req, p.listenAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+
+	// the answer is cached after it was sent to the client
+	for i := 0; i < 50; i++ {
+		if _, ok := cache.table.Peek(cacheKey(req)); ok {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	age(cache, cacheKey(req), time.Hour)
+
+	resp, _, err := client.Exchange(req, p.listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("expect stale answer, got %v", resp)
+	}
+}
+
+func TestServeStaleServfail(t *testing.T) {
+	var failing int32
+	upper, stop := startUpper(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if atomic.LoadInt32(&failing) == 1 {
+			resp := &dns.Msg{}
+			resp.SetRcode(req, dns.RcodeServerFailure)
+			w.WriteMsg(resp)
+			return
+		}
+		answerA("1.2.3.4")(w, req)
+	})
+	defer stop()
+	cache := NewCache(&CacheConfig{Enable: true, StaleTTL: 3600})
+	defer cache.Close()
+	p := startProxy(t, &ProxyConfig{Upper: []string{upper}, Timeout: 1}, cache, nil)
+	defer p.Stop()
+
+	req := &dns.Msg{}
+	req.SetQuestion("stale.example.com.", dns.TypeA)
+	client := &dns.Client{Timeout: 5 * time.Second}
+	if _, _, err := client.Exchange(req, p.listenAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if _, ok := cache.table.Peek(cacheKey(req)); ok {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	age(cache, cacheKey(req), time.Hour)
+	atomic.StoreInt32(&failing, 1)
+
+	resp, _, err := client.Exchange(req, p.listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("expect stale answer instead of SERVFAIL, got %v", resp)
+	}
+}
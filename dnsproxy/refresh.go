@@ -0,0 +1,68 @@
+package dnsproxy
+
+import (
+	"strings"
+
+	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
+)
+
+// serveStale answers with an expired cache entry when every upstream
+// failed, and tries to refresh it in the background. It reports whether
+// the client was answered.
+func (p *Proxy) serveStale(domain string, ctx *clientContext, upper []*trackedUpstream) bool {
+	if p.cache == nil {
+		return false
+	}
+
+	key := cacheKey(ctx.req)
+	stale := p.cache.GetStale(key)
+	if stale == nil {
+		return false
+	}
+
+	if err := p.handleCache(domain, ctx, stale); err != nil {
+		logs.Warn("response stale result fail: %v", err)
+		return true
+	}
+
+	logs.Debug("%s => %s", domain, "stale cache")
+	go p.refresh(key, ctx.req, upper)
+	return true
+}
+
+// refresh resolves req again and updates its cache entry. Only one refresh
+// per key runs at a time.
+func (p *Proxy) refresh(key string, req *dns.Msg, upper []*trackedUpstream) {
+	p.refreshMu.Lock()
+	if p.refreshing[key] {
+		p.refreshMu.Unlock()
+		return
+	}
+	p.refreshing[key] = true
+	p.refreshMu.Unlock()
+
+	defer func() {
+		p.refreshMu.Lock()
+		delete(p.refreshing, key)
+		p.refreshMu.Unlock()
+	}()
+
+	resp, up, err := p.exchange(upper, req)
+	if err != nil {
+		logs.Debug("refresh %s fail: %v", key, err)
+		return
+	}
+
+	if cacheable(resp) {
+		logs.Debug("refresh %s => %s", key, up)
+		p.cache.Set(key, resp)
+	}
+}
+
+// prefetch refreshes the cached answer of key before it expires, through
+// the upstreams its domain is routed to.
+func (p *Proxy) prefetch(key string, req *dns.Msg) {
+	domain := strings.TrimSuffix(strings.ToLower(req.Question[0].Name), ".")
+	go p.refresh(key, req, p.upstreamsFor(domain))
+}
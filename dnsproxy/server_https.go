@@ -0,0 +1,235 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohJSONMediaType = "application/dns-json"
+
+var errInvalidType = errors.New("invalid type")
+
+// HTTPSServerConfig enables serving DNS-over-HTTPS to clients. Without
+// cert_file and key_file it serves plain http, for use behind a reverse
+// proxy terminating tls.
+type HTTPSServerConfig struct {
+	ListenAddr string `toml:"listen_addr"`
+	Path       string `toml:"path"`
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+}
+
+func (p *Proxy) newHTTPSServer(cfg *HTTPSServerConfig) (*http.Server, error) {
+	addr := cfg.ListenAddr
+	if addr == "" {
+		addr = defaultHTTPSAddr
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = defaultDoHPath
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, p.dohHandler)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: cert.GetCertificate}
+	}
+
+	return srv, nil
+}
+
+// httpWriter hands the answer of a DoH query back to the http handler
+// waiting for it.
+type httpWriter struct {
+	ch chan []byte
+}
+
+func (w *httpWriter) WriteMsg(msg []byte) error {
+	select {
+	case w.ch <- msg:
+	default:
+	}
+	return nil
+}
+
+// dohHandler serves RFC 8484 GET (?dns=) and POST requests, and the json
+// flavour (?name=&type=) used by browsers and curl.
+func (p *Proxy) dohHandler(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+	jsonReq := false
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if param := q.Get("dns"); param != "" {
+			buf, err = base64.RawURLEncoding.DecodeString(param)
+		} else if name := q.Get("name"); name != "" {
+			jsonReq = true
+			buf, err = jsonQuery(name, q.Get("type"), q.Get("do"))
+		} else {
+			http.Error(w, "missing dns or name parameter", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+			http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the workers drop invalid queries silently, answer them here
+	req := &dns.Msg{}
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, "invalid dns query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Question) == 0 {
+		http.Error(w, "dns query without question", http.StatusBadRequest)
+		return
+	}
+
+	hw := &httpWriter{ch: make(chan []byte, 1)}
+	p.onQuery(&clientContext{w: hw, buf: buf})
+
+	timer := time.NewTimer(p.timeout * time.Duration(len(p.upper)+1))
+	defer timer.Stop()
+
+	var msg []byte
+	select {
+	case msg = <-hw.ch:
+	case <-timer.C:
+		http.Error(w, "no answer from upper", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	resp := &dns.Msg{}
+	if err := resp.Unpack(msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if ttl, ok := minTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl)))
+	}
+
+	if jsonReq {
+		w.Header().Set("Content-Type", dohJSONMediaType)
+		json.NewEncoder(w).Encode(newJSONMsg(resp))
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(msg)
+}
+
+// jsonQuery packs the query of a json request, qtype is a type name like
+// "AAAA" or a number and defaults to A.
+func jsonQuery(name, qtype, do string) ([]byte, error) {
+	t := dns.TypeA
+	if qtype != "" {
+		if v, ok := dns.StringToType[strings.ToUpper(qtype)]; ok {
+			t = v
+		} else if v, err := strconv.ParseUint(qtype, 10, 16); err == nil {
+			t = uint16(v)
+		} else {
+			return nil, errInvalidType
+		}
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), t)
+	if do == "1" || do == "true" {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return req.Pack()
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonMsg is the application/dns-json answer format, as served by the
+// Google and Cloudflare resolvers.
+type jsonMsg struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+}
+
+func newJSONMsg(msg *dns.Msg) *jsonMsg {
+	jm := &jsonMsg{
+		Status: msg.Rcode,
+		TC:     msg.Truncated,
+		RD:     msg.RecursionDesired,
+		RA:     msg.RecursionAvailable,
+		AD:     msg.AuthenticatedData,
+		CD:     msg.CheckingDisabled,
+	}
+
+	for _, q := range msg.Question {
+		jm.Question = append(jm.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+
+	jm.Answer = newJSONRRs(msg.Answer)
+	jm.Authority = newJSONRRs(msg.Ns)
+	return jm
+}
+
+func newJSONRRs(rrs []dns.RR) []jsonRR {
+	var out []jsonRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		out = append(out, jsonRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return out
+}
@@ -0,0 +1,207 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
+)
+
+// strategies choosing the order upstreams of a query are tried in
+const (
+	strategySequential = "sequential"  // in configured order
+	strategyParallel   = "parallel"    // all at once, first valid answer wins
+	strategyRandom     = "random"      // in random order
+	strategyRoundRobin = "round_robin" // starting from the next upstream each query
+	strategyFastest    = "fastest"     // lowest measured rtt first
+)
+
+// rttDecay is the weight of the latest sample in the smoothed rtt.
+const rttDecay = 0.3
+
+var errNoUpstream = errors.New("no upstream")
+
+func validStrategy(strategy string) bool {
+	switch strategy {
+	case strategySequential, strategyParallel, strategyRandom, strategyRoundRobin, strategyFastest:
+		return true
+	}
+	return false
+}
+
+// trackedUpstream measures the round trip time and the health of an
+// upstream.
+type trackedUpstream struct {
+	upstream
+	timeout time.Duration
+	health  *healthOptions
+
+	mu        sync.Mutex
+	rtt       time.Duration
+	fails     int
+	down      bool
+	lastTried time.Time
+}
+
+func (u *trackedUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := u.upstream.Exchange(req)
+
+	// a SERVFAIL or REFUSED answer counts as a failure for health too, but
+	// the answer is still returned to the caller
+	fail := err
+	if fail == nil && !validAnswer(resp) {
+		fail = fmt.Errorf("answer rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	rtt := time.Since(start)
+	if fail != nil {
+		// a failed upstream is ranked as if it took the whole timeout
+		rtt = u.timeout
+	}
+
+	u.mu.Lock()
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = time.Duration(rttDecay*float64(rtt) + (1-rttDecay)*float64(u.rtt))
+	}
+	u.mu.Unlock()
+
+	u.report(fail)
+	return resp, err
+}
+
+func (u *trackedUpstream) RTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.rtt
+}
+
+// exchange resolves req with ups according to the configured strategy and
+// returns the answer with the upstream that gave it.
+func (p *Proxy) exchange(ups []*trackedUpstream, req *dns.Msg) (*dns.Msg, *trackedUpstream, error) {
+	if len(ups) == 0 {
+		return nil, nil, errNoUpstream
+	}
+
+	ups = available(ups)
+	if p.strategy == strategyParallel {
+		return p.exchangeParallel(ups, req)
+	}
+
+	return p.exchangeSequential(p.order(ups), req)
+}
+
+// order returns ups in the order they are tried for the strategy.
+func (p *Proxy) order(ups []*trackedUpstream) []*trackedUpstream {
+	if len(ups) <= 1 {
+		return ups
+	}
+
+	ordered := make([]*trackedUpstream, len(ups))
+	switch p.strategy {
+	case strategyRandom:
+		for i, j := range rand.Perm(len(ups)) {
+			ordered[i] = ups[j]
+		}
+
+	case strategyRoundRobin:
+		start := int(atomic.AddUint32(&p.rrIndex, 1) % uint32(len(ups)))
+		for i := range ups {
+			ordered[i] = ups[(start+i)%len(ups)]
+		}
+
+	case strategyFastest:
+		// upstreams never measured have a zero rtt and get probed first
+		copy(ordered, ups)
+		rtts := make(map[*trackedUpstream]time.Duration, len(ups))
+		for _, up := range ups {
+			rtts[up] = up.RTT()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return rtts[ordered[i]] < rtts[ordered[j]]
+		})
+
+	default:
+		copy(ordered, ups)
+	}
+
+	return ordered
+}
+
+func (p *Proxy) exchangeSequential(ups []*trackedUpstream, req *dns.Msg) (*dns.Msg, *trackedUpstream, error) {
+	var lastResp *dns.Msg
+	var lastUp *trackedUpstream
+	var lastErr error
+
+	for _, up := range ups {
+		resp, err := up.Exchange(req)
+		if err != nil {
+			logs.Warn("resolve from upper: %s fail: %v", up, err)
+			lastErr = err
+			continue
+		}
+
+		if validAnswer(resp) {
+			return resp, up, nil
+		}
+
+		logs.Debug("upper %s answered %s, try next", up, dns.RcodeToString[resp.Rcode])
+		lastResp, lastUp = resp, up
+	}
+
+	if lastResp != nil {
+		return lastResp, lastUp, nil
+	}
+	return nil, nil, lastErr
+}
+
+type exchangeResult struct {
+	resp *dns.Msg
+	up   *trackedUpstream
+	err  error
+}
+
+// exchangeParallel sends req to all ups at once and returns the first valid
+// answer without waiting for the others.
+func (p *Proxy) exchangeParallel(ups []*trackedUpstream, req *dns.Msg) (*dns.Msg, *trackedUpstream, error) {
+	results := make(chan exchangeResult, len(ups))
+	for _, up := range ups {
+		go func(up *trackedUpstream) {
+			resp, err := up.Exchange(req)
+			results <- exchangeResult{resp, up, err}
+		}(up)
+	}
+
+	var last exchangeResult
+	for range ups {
+		r := <-results
+		if r.err != nil {
+			logs.Warn("resolve from upper: %s fail: %v", r.up, r.err)
+			if last.resp == nil {
+				last = r
+			}
+			continue
+		}
+
+		if validAnswer(r.resp) {
+			return r.resp, r.up, nil
+		}
+		last = r
+	}
+
+	return last.resp, last.up, last.err
+}
+
+// validAnswer reports whether resp is worth returning to the client rather
+// than trying another upstream.
+func validAnswer(resp *dns.Msg) bool {
+	return resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
@@ -0,0 +1,98 @@
+package dnsproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDeadUpper returns the address of a udp socket that never answers.
+func startDeadUpper(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc.LocalAddr().String(), func() { pc.Close() }
+}
+
+func delayed(d time.Duration, h dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(d)
+		h(w, req)
+	}
+}
+
+func TestStrategyParallel(t *testing.T) {
+	dead, stopDead := startDeadUpper(t)
+	defer stopDead()
+	live, stopLive := startUpper(t, answerA("1.2.3.4"))
+	defer stopLive()
+
+	p := NewProxy(&ProxyConfig{Upper: []string{dead, live}, Strategy: "parallel", Timeout: 2}, nil, nil)
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+
+	start := time.Now()
+	resp, up, err := p.exchange(p.upper, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if up.String() != live || len(resp.Answer) != 1 {
+		t.Errorf("expect answer from %s, got %v from %s", live, resp, up)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect parallel answer without waiting for the dead upper, took %v", elapsed)
+	}
+}
+
+func TestStrategyFastest(t *testing.T) {
+	slow, stopSlow := startUpper(t, delayed(100*time.Millisecond, answerA("1.1.1.1")))
+	defer stopSlow()
+	fast, stopFast := startUpper(t, answerA("2.2.2.2"))
+	defer stopFast()
+
+	p := NewProxy(&ProxyConfig{Upper: []string{slow, fast}, Strategy: "fastest"}, nil, nil)
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	for _, up := range p.upper {
+		if _, err := up.Exchange(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		_, up, err := p.exchange(p.upper, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if up.String() != fast {
+			t.Errorf("expect fastest upper %s, got %s", fast, up)
+		}
+	}
+}
+
+func TestStrategyRoundRobin(t *testing.T) {
+	p := NewProxy(&ProxyConfig{Upper: []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}, Strategy: "round_robin"}, nil, nil)
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[p.order(p.upper)[0].String()] = true
+	}
+
+	if len(seen) != 3 {
+		t.Errorf("expect every upper tried first once, got %v", seen)
+	}
+}
+
+func TestStrategyInvalid(t *testing.T) {
+	if p := NewProxy(&ProxyConfig{Upper: []string{"127.0.0.1:53"}, Strategy: "fast"}, nil, nil); p != nil {
+		t.Error("expect nil proxy for unknown strategy")
+	}
+}
@@ -0,0 +1,143 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+)
+
+// tcpWriter answers queries received on a stream connection. Queries of one
+// connection are handled concurrently by the workers, so writes are
+// serialized and each answer is framed with its two-byte length (RFC 7766).
+type tcpWriter struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *tcpWriter) WriteMsg(msg []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	err := writeTCPMsg(w.conn, msg)
+	w.conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+func (p *Proxy) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-p.done:
+				return nil
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logs.Warn("tcp accept fail: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go p.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn reads pipelined queries from conn until the client closes it
+// or stays idle longer than idleTimeout. The connection is only idle while
+// no query is outstanding (RFC 7766 6.2.3), and it is closed once the
+// outstanding queries are answered.
+func (p *Proxy) serveTCPConn(conn net.Conn) {
+	var pending sync.WaitGroup
+	var mu sync.Mutex
+	inflight := 0
+
+	// armIdle sets the idle deadline when no query is outstanding, mu held
+	armIdle := func() {
+		if inflight == 0 {
+			conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	finish := func() {
+		mu.Lock()
+		inflight--
+		armIdle()
+		mu.Unlock()
+		pending.Done()
+	}
+
+	defer func() {
+		waitc := make(chan struct{})
+		go func() {
+			pending.Wait()
+			close(waitc)
+		}()
+
+		select {
+		case <-waitc:
+		case <-p.done:
+		}
+		conn.Close()
+	}()
+
+	w := &tcpWriter{conn: conn, timeout: p.timeout}
+	for {
+		mu.Lock()
+		armIdle()
+		mu.Unlock()
+
+		buf, err := readTCPMsg(conn)
+		if err != nil {
+			if err != io.EOF {
+				logs.Debug("tcp client %s closed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		mu.Lock()
+		inflight++
+		mu.Unlock()
+		pending.Add(1)
+		p.onQuery(&clientContext{w: w, buf: buf, finish: finish})
+	}
+}
+
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
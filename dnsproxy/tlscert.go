@@ -0,0 +1,92 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+)
+
+var certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of a tls listener and loads it again
+// when the cert or key file is replaced, so renewed certificates are picked
+// up without restarting. A broken new pair is logged and the old one kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	modTime, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return r, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+
+	modTime, err := r.stat()
+	if err != nil {
+		logs.Warn("stat certificate %s fail: %v", r.certFile, err)
+		return r.cert, nil
+	}
+
+	if !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		logs.Warn("reload certificate %s fail, keep the old one: %v", r.certFile, err)
+		return r.cert, nil
+	}
+
+	logs.Info("certificate %s reloaded", r.certFile)
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}
+
+// stat returns the latest modification time of the cert and key files.
+func (r *certReloader) stat() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,218 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	logs "github.com/jursonmo/beelogs"
+	"github.com/miekg/dns"
+)
+
+// upstream is a dns server queries are forwarded to. Depending on the
+// prefix of its address it is reached over plain udp/tcp ("8.8.8.8:53"),
+// over tls ("tls://1.1.1.1:853#cloudflare-dns.com") or over https
+// ("https://dns.google/dns-query"). Close releases its connections, it is
+// not dialed again afterwards.
+type upstream interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+	String() string
+	Close()
+}
+
+var errUpstreamClosed = errors.New("upstream closed")
+
+// getUpstream returns the upstream for addr, upstreams are created once
+// so that their connections are shared by the global upper list and the
+// server= policies.
+func (p *Proxy) getUpstream(addr string) (*trackedUpstream, error) {
+	p.upsMu.Lock()
+	defer p.upsMu.Unlock()
+
+	if up, ok := p.upstreams[addr]; ok {
+		return up, nil
+	}
+
+	up, err := p.newUpstream(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tu := &trackedUpstream{upstream: up, timeout: p.timeout, health: p.health}
+	p.upstreams[addr] = tu
+	return tu, nil
+}
+
+// pruneUpstreams drops the upstreams neither the upper list nor the
+// reloaded policy refers to, so that they are no longer probed. They are
+// closed once the queries still using them are over.
+func (p *Proxy) pruneUpstreams() {
+	used := make(map[*trackedUpstream]bool, len(p.upper))
+	for _, up := range p.upper {
+		used[up] = true
+	}
+
+	servers := make(map[string]bool)
+	if p.policy != nil {
+		for _, addr := range p.policy.Servers() {
+			servers[addr] = true
+		}
+	}
+
+	p.upsMu.Lock()
+	defer p.upsMu.Unlock()
+
+	for addr, up := range p.upstreams {
+		if used[up] || servers[addr] {
+			continue
+		}
+
+		logs.Info("upper %s no longer used, close it", addr)
+		delete(p.upstreams, addr)
+		time.AfterFunc(p.timeout, up.Close)
+	}
+}
+
+func (p *Proxy) newUpstream(addr string) (upstream, error) {
+	switch {
+	case strings.HasPrefix(addr, "tls://"):
+		return newTLSUpstream(strings.TrimPrefix(addr, "tls://"), p.tlsConfig, p.timeout)
+
+	case strings.HasPrefix(addr, "https://"):
+		return newHTTPSUpstream(addr, p.dohMethod, p.tlsConfig, p.timeout)
+
+	case strings.Contains(addr, "://"):
+		return nil, fmt.Errorf("unsupported upstream scheme")
+
+	default:
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, err
+		}
+		return newUDPUpstream(addr, p.poolSize, p.rotate, p.timeout), nil
+	}
+}
+
+// policyUpstreams maps the server= addresses of a policy to upstreams,
+// invalid ones are skipped.
+func (p *Proxy) policyUpstreams(addrs []string) []*trackedUpstream {
+	ups := make([]*trackedUpstream, 0, len(addrs))
+	for _, addr := range addrs {
+		up, err := p.getUpstream(addr)
+		if err != nil {
+			logs.Warn("invalid policy server %s: %v", addr, err)
+			continue
+		}
+		ups = append(ups, up)
+	}
+	return ups
+}
+
+// udpUpstream is a plain dns server, queried over a pool of long-lived
+// udp sockets and over tcp when the udp answer comes back truncated.
+//
+// A long-lived socket keeps its source port, leaving only the 16-bit query
+// id for an off-path attacker to guess. Each socket is therefore replaced
+// after rotate queries, trading a new socket now and then for a source
+// port that keeps moving.
+type udpUpstream struct {
+	addr    string
+	timeout time.Duration
+	rotate  int
+
+	mu     sync.Mutex
+	conns  []*muxConn
+	uses   []int
+	next   int
+	closed bool
+}
+
+func newUDPUpstream(addr string, poolSize, rotate int, timeout time.Duration) *udpUpstream {
+	return &udpUpstream{
+		addr:    addr,
+		timeout: timeout,
+		rotate:  rotate,
+		conns:   make([]*muxConn, poolSize),
+		uses:    make([]int, poolSize),
+	}
+}
+
+func (u *udpUpstream) String() string {
+	return u.addr
+}
+
+func (u *udpUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	rmsg, err := conn.Exchange(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rmsg.Truncated {
+		logs.Debug("truncated answer from upper: %s, retry over tcp", u.addr)
+		return u.resolveTCP(req)
+	}
+
+	return rmsg, nil
+}
+
+// getConn picks the sockets of the pool in turn, a socket is dialed again
+// once it failed or served rotate queries.
+func (u *udpUpstream) getConn() (*muxConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil, errUpstreamClosed
+	}
+
+	i := u.next
+	u.next = (u.next + 1) % len(u.conns)
+	if old := u.conns[i]; old != nil && !old.Closed() {
+		if u.uses[i] < u.rotate {
+			u.uses[i]++
+			return old, nil
+		}
+		// queries still waiting on the old socket are over by timeout
+		time.AfterFunc(u.timeout, old.Close)
+	}
+
+	conn, err := net.DialTimeout("udp", u.addr, u.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	u.conns[i] = newMuxConn(conn, u.timeout)
+	u.uses[i] = 1
+	return u.conns[i], nil
+}
+
+func (u *udpUpstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	for _, conn := range u.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func (u *udpUpstream) resolveTCP(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := net.DialTimeout("tcp", u.addr, u.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMuxConn(conn, u.timeout)
+	defer m.Close()
+
+	return m.Exchange(req)
+}
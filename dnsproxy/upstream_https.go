@@ -0,0 +1,129 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// httpsUpstream is a DNS-over-HTTPS server (RFC 8484) queried with the
+// wire format over POST or GET. Connections are pooled by the http client
+// and multiplexed over HTTP/2 when the server supports it.
+type httpsUpstream struct {
+	url    string
+	method string
+	client *http.Client
+}
+
+func newHTTPSUpstream(rawurl, method string, base *tls.Config, timeout time.Duration) (*httpsUpstream, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     base.Clone(),
+		TLSHandshakeTimeout: timeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &httpsUpstream{
+		url:    rawurl,
+		method: method,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+// Close drops the idle connections, a busy one is dropped once it has
+// been idle for IdleConnTimeout.
+func (u *httpsUpstream) Close() {
+	u.client.CloseIdleConnections()
+}
+
+func (u *httpsUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 4.1, id 0 makes GET requests cache friendly
+	out := *req
+	out.Id = 0
+	buf, err := out.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var hreq *http.Request
+	if u.method == http.MethodGet {
+		sep := "?"
+		if strings.Contains(u.url, "?") {
+			sep = "&"
+		}
+		hreq, err = http.NewRequest(http.MethodGet, u.url+sep+"dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		hreq, err = http.NewRequest(http.MethodPost, u.url, bytes.NewReader(buf))
+		if err == nil {
+			hreq.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Accept", dohMediaType)
+
+	hresp, err := u.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, hresp.Body)
+		return nil, fmt.Errorf("http status %s", hresp.Status)
+	}
+
+	if ct := hresp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("unexpected content type %s", ct)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	rmsg := &dns.Msg{}
+	err = rmsg.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if rmsg.Id != out.Id {
+		return nil, fmt.Errorf("id mismatch")
+	}
+
+	err = matchResponse(req, rmsg)
+	if err != nil {
+		return nil, err
+	}
+
+	rmsg.Id = req.Id
+	return rmsg, nil
+}
@@ -0,0 +1,366 @@
+package dnsproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCert writes a self signed certificate for name and its key into
+// dir and returns the certificate and key paths.
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+type countListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestTLSUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "dns.test")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countListener{Listener: ln}
+	srv := &dns.Server{
+		Listener: tls.NewListener(cl, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		Net:      "tcp-tls",
+		Handler:  answerA("5.6.7.8"),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	p := NewProxy(&ProxyConfig{
+		Upper:       []string{"tls://" + ln.Addr().String() + "#dns.test"},
+		UpperCAFile: certFile,
+	}, nil, nil)
+	if p == nil {
+		t.Fatal("expect proxy, got nil")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := &dns.Msg{}
+			req.SetQuestion(dns.Fqdn(string('a'+byte(i))+".example.com"), dns.TypeA)
+			resp, err := p.upper[0].Exchange(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if resp.Id != req.Id || len(resp.Answer) != 1 || resp.Answer[0].Header().Name != req.Question[0].Name {
+				t.Errorf("unexpected response %v for %v", resp, req)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&cl.accepted); n != 1 {
+		t.Errorf("expect queries pipelined on 1 connection, got %d", n)
+	}
+}
+
+func TestTLSUpstreamVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "dns.test")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: answerA("5.6.7.8")}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	p := NewProxy(&ProxyConfig{
+		Upper:       []string{"tls://" + ln.Addr().String() + "#other.test"},
+		UpperCAFile: certFile,
+	}, nil, nil)
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	if _, err := p.upper[0].Exchange(req); err == nil {
+		t.Error("expect certificate verification failure for wrong server name")
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	var proto int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+
+		var buf []byte
+		var err error
+		if r.Method == http.MethodGet {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			buf, err = ioutil.ReadAll(r.Body)
+		}
+
+		req := &dns.Msg{}
+		if err != nil || req.Unpack(buf) != nil || req.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 9.9.9.9")
+		resp.Answer = append(resp.Answer, rr)
+		out, _ := resp.Pack()
+
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(out)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"get", "post"} {
+		p := NewProxy(&ProxyConfig{
+			Upper:       []string{srv.URL + "/dns-query"},
+			UpperCAFile: caFile,
+			DoHMethod:   method,
+		}, nil, nil)
+		if p == nil {
+			t.Fatal("expect proxy, got nil")
+		}
+
+		req := &dns.Msg{}
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		resp, err := p.upper[0].Exchange(req)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+
+		if resp.Id != req.Id || len(resp.Answer) != 1 {
+			t.Errorf("%s: unexpected response %v", method, resp)
+		}
+
+		if atomic.LoadInt32(&proto) != 2 {
+			t.Errorf("%s: expect HTTP/2, got HTTP/%d", method, atomic.LoadInt32(&proto))
+		}
+	}
+}
+
+func TestUDPUpstreamPool(t *testing.T) {
+	var mu sync.Mutex
+	ports := map[string]bool{}
+	upper, stop := startUpper(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		ports[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		answerA("1.2.3.4")(w, req)
+	})
+	defer stop()
+
+	p := NewProxy(&ProxyConfig{Upper: []string{upper}, PoolSize: 2}, nil, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := &dns.Msg{}
+			req.SetQuestion(dns.Fqdn(string('a'+byte(i%26))+".example.com"), dns.TypeA)
+			resp, err := p.upper[0].Exchange(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if resp.Id != req.Id || resp.Answer[0].Header().Name != req.Question[0].Name {
+				t.Errorf("unexpected response %v for %v", resp, req)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) != 2 {
+		t.Errorf("expect queries multiplexed on 2 sockets, got %d", len(ports))
+	}
+}
+
+func TestUDPUpstreamRotate(t *testing.T) {
+	var mu sync.Mutex
+	ports := map[string]int{}
+	upper, stop := startUpper(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		ports[w.RemoteAddr().String()]++
+		mu.Unlock()
+		answerA("1.2.3.4")(w, req)
+	})
+	defer stop()
+
+	p := NewProxy(&ProxyConfig{Upper: []string{upper}, PoolSize: 1, PoolRotate: 5}, nil, nil)
+
+	for i := 0; i < 20; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		if _, err := p.upper[0].Exchange(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) != 4 {
+		t.Errorf("expect 4 source ports after 20 queries, got %v", ports)
+	}
+	for port, n := range ports {
+		if n != 5 {
+			t.Errorf("expect 5 queries from %s, got %d", port, n)
+		}
+	}
+}
+
+func TestUpstreamDropsSpoofedResponses(t *testing.T) {
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	upper, stop := startUpper(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		spoof := func(id uint16, name string, from net.PacketConn) {
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+			resp.Id = id
+			resp.Question[0].Name = name
+			rr, _ := dns.NewRR(name + " 300 IN A 6.6.6.6")
+			resp.Answer = append(resp.Answer, rr)
+			if from != nil {
+				buf, _ := resp.Pack()
+				from.WriteTo(buf, w.RemoteAddr())
+			} else {
+				w.WriteMsg(resp)
+			}
+		}
+
+		name := req.Question[0].Name
+		spoof(req.Id+1, name, nil)
+		spoof(req.Id, "evil.example.com.", nil)
+		spoof(req.Id, name, spoofer)
+		time.Sleep(50 * time.Millisecond)
+		answerA("1.2.3.4")(w, req)
+	})
+	defer stop()
+
+	p := NewProxy(&ProxyConfig{Upper: []string{upper}}, nil, nil)
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	resp, err := p.upper[0].Exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("expect genuine answer, got %v", resp)
+	}
+}
@@ -0,0 +1,110 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultTLSPort = "853"
+
+// tlsUpstream is a DNS-over-TLS server (RFC 7858). All queries share one
+// pipelined connection, which is redialed once it fails or the server
+// closes it.
+type tlsUpstream struct {
+	name    string
+	addr    string
+	config  *tls.Config
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   *muxConn
+	closed bool
+}
+
+// newTLSUpstream parses "host[:port][#servername]", servername is used for
+// SNI and certificate verification and defaults to host.
+func newTLSUpstream(spec string, base *tls.Config, timeout time.Duration) (*tlsUpstream, error) {
+	addr, serverName := spec, ""
+	if i := strings.Index(spec, "#"); i >= 0 {
+		addr, serverName = spec[:i], spec[i+1:]
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(addr, defaultTLSPort)
+	}
+
+	if serverName == "" {
+		serverName = host
+	}
+
+	config := base.Clone()
+	config.ServerName = serverName
+
+	return &tlsUpstream{
+		name:    "tls://" + spec,
+		addr:    addr,
+		config:  config,
+		timeout: timeout,
+	}, nil
+}
+
+func (u *tlsUpstream) String() string {
+	return u.name
+}
+
+func (u *tlsUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := u.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := conn.Exchange(req)
+	if err != nil && reused && conn.Closed() {
+		// the server may have closed an idle connection, try a fresh one
+		conn, _, err = u.getConn()
+		if err != nil {
+			return nil, err
+		}
+		return conn.Exchange(req)
+	}
+
+	return resp, err
+}
+
+func (u *tlsUpstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	if u.conn != nil {
+		u.conn.Close()
+	}
+}
+
+func (u *tlsUpstream) getConn() (*muxConn, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil, false, errUpstreamClosed
+	}
+	if u.conn != nil && !u.conn.Closed() {
+		return u.conn, true, nil
+	}
+
+	dialer := &net.Dialer{Timeout: u.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.addr, u.config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	u.conn = newMuxConn(conn, u.timeout)
+	return u.conn, false, nil
+}
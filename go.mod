@@ -1,6 +1,6 @@
 module github.com/jursonmo/go-dns-proxy
 
-go 1.12
+go 1.13
 
 require (
 	github.com/BurntSushi/toml v0.3.1